@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maikirakiwi/goportforward/forward"
+)
+
+// accessLog appends a line for every finished TCP connection to a file,
+// separately from the process log.
+type accessLog struct {
+	path, format string
+
+	mu   sync.Mutex
+	file *os.File
+
+	targets sync.Map // connection ID -> target address, between connect and close
+}
+
+// openAccessLog opens path for appending, creating it if needed. format
+// is "tsv" or "json".
+func openAccessLog(path, format string) (*accessLog, error) {
+	switch format {
+	case "tsv", "json":
+	default:
+		return nil, fmt.Errorf("invalid access log format %q (want tsv or json)", format)
+	}
+	l := &accessLog{path: path, format: format}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reopen switches to a fresh file at the log's path, e.g. once logrotate
+// has moved the old one away. On failure the current file is kept.
+func (l *accessLog) reopen() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %v", err)
+	}
+	l.mu.Lock()
+	old := l.file
+	l.file = file
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (l *accessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// accessEntry is one line of the access log.
+type accessEntry struct {
+	Time     time.Time `json:"time"`
+	ID       uint64    `json:"conn"`
+	Source   string    `json:"source"`
+	Client   string    `json:"client"`
+	Target   string    `json:"target"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Duration float64   `json:"duration"` // seconds
+	Reason   string    `json:"reason"`
+}
+
+// tsvEscaper keeps free-form fields on one line and in one column.
+var tsvEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+func (e *accessEntry) tsv() string {
+	fields := []string{
+		e.Time.Format(time.RFC3339Nano),
+		strconv.FormatUint(e.ID, 10),
+		e.Source,
+		e.Client,
+		e.Target,
+		strconv.FormatInt(e.BytesIn, 10),
+		strconv.FormatInt(e.BytesOut, 10),
+		strconv.FormatFloat(e.Duration, 'f', 3, 64),
+		e.Reason,
+	}
+	for i, field := range fields {
+		if field == "" {
+			field = "-"
+		}
+		fields[i] = tsvEscaper.Replace(field)
+	}
+	return strings.Join(fields, "\t") + "\n"
+}
+
+// hook makes f log its connections, tagged with the rule's source.
+func (l *accessLog) hook(f *forward.Forwarder, source string) {
+	addOnConnect(f, func(id uint64, client, target net.Addr) {
+		l.targets.Store(id, target.String())
+	})
+	addOnClose(f, func(id uint64, client net.Addr, bytesIn, bytesOut int64, dur time.Duration, err error) {
+		e := accessEntry{
+			Time:     time.Now(),
+			ID:       id,
+			Source:   source,
+			Client:   client.String(),
+			BytesIn:  bytesIn,
+			BytesOut: bytesOut,
+			Duration: dur.Seconds(),
+			Reason:   closeReason(err),
+		}
+		if target, ok := l.targets.LoadAndDelete(id); ok {
+			e.Target = target.(string)
+		}
+		l.write(&e)
+	})
+}
+
+// closeReason describes why a connection ended, given the error passed to
+// OnClose.
+func closeReason(err error) string {
+	if err == nil {
+		return "closed"
+	}
+	return err.Error()
+}
+
+func (l *accessLog) write(e *accessEntry) {
+	var line []byte
+	if l.format == "json" {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = []byte(e.tsv())
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(line); err != nil {
+		slog.Warn("Failed to write access log", "path", l.path, "error", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/maikirakiwi/goportforward/forward"
+)
+
+// startAdmin serves the JSON admin API for sup's rules on addr until ctx
+// is done.
+func startAdmin(ctx context.Context, addr string, sup *supervisor) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, adminStats(sup.stats()))
+	})
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, adminConns(sup.conns(), time.Now()))
+	})
+	mux.HandleFunc("POST /connections/{id}/close", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid connection ID")
+			return
+		}
+		if !sup.closeConn(id) {
+			writeJSONError(w, http.StatusNotFound, "no such connection")
+			return
+		}
+		slog.Info("Closing connection from admin API", "conn", id, "remote", r.RemoteAddr)
+		writeJSON(w, map[string]string{"status": "closed"})
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		draining, active := sup.status()
+		writeJSON(w, statusJSON{Draining: draining, Active: active})
+	})
+	mux.HandleFunc("POST /drain", func(w http.ResponseWriter, r *http.Request) {
+		if sup.drain() {
+			slog.Info("Draining from admin API, no longer accepting", "remote", r.RemoteAddr)
+		}
+		draining, active := sup.status()
+		writeJSON(w, statusJSON{Draining: draining, Active: active})
+	})
+	ln, err := serveHTTP(ctx, "admin", addr, mux)
+	if err != nil {
+		return err
+	}
+	slog.Info("Serving admin API", "url", "http://"+ln.Addr().String())
+	return nil
+}
+
+// statusJSON is the body of /status and /drain.
+type statusJSON struct {
+	Draining bool  `json:"draining"`
+	Active   int64 `json:"active"`
+}
+
+// statsJSON is the body of /stats, and of each rule in it.
+type statsJSON struct {
+	Protocol string `json:"protocol,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Target   string `json:"target,omitempty"`
+
+	Accepted      uint64 `json:"accepted"`
+	Failed        uint64 `json:"failed"`
+	Active        int64  `json:"active"`
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+
+	Latency []latencyJSON `json:"latency,omitempty"`
+
+	Rules []statsJSON `json:"rules,omitempty"`
+}
+
+// latencyJSON is the connect latency of one target of a rule, in seconds.
+type latencyJSON struct {
+	Target   string     `json:"target"`
+	Last     float64    `json:"last"`
+	LastAt   *time.Time `json:"last_at,omitempty"`
+	Min      float64    `json:"min"`
+	Avg      float64    `json:"avg"`
+	Max      float64    `json:"max"`
+	Probes   int        `json:"probes"`
+	Failures int        `json:"failures"`
+}
+
+func (s *statsJSON) add(st forward.Stats) {
+	s.Accepted += st.Accepted
+	s.Failed += st.Failed
+	s.Active += st.Active
+	s.BytesSent += st.BytesSent
+	s.BytesReceived += st.BytesReceived
+}
+
+// adminStats totals the counters of all rules, listing each rule's own
+// counters alongside.
+func adminStats(stats []ruleStats) statsJSON {
+	total := statsJSON{Rules: []statsJSON{}}
+	for _, rs := range stats {
+		rule := statsJSON{Protocol: rs.rule.Protocol, Source: rs.rule.Source, Target: rs.rule.Target}
+		rule.add(rs.stats)
+		for _, l := range rs.latencies {
+			lj := latencyJSON{Target: l.Target, Last: l.Last.Seconds(), Min: l.Min.Seconds(), Avg: l.Avg.Seconds(),
+				Max: l.Max.Seconds(), Probes: l.Probes, Failures: l.Failures}
+			if !l.LastAt.IsZero() {
+				lj.LastAt = &l.LastAt
+			}
+			rule.Latency = append(rule.Latency, lj)
+		}
+		total.add(rs.stats)
+		total.Rules = append(total.Rules, rule)
+	}
+	return total
+}
+
+// connJSON is one entry of /connections.
+type connJSON struct {
+	ID       uint64    `json:"id"`
+	Source   string    `json:"source"`
+	Client   string    `json:"client"`
+	Target   string    `json:"target"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Accepted time.Time `json:"accepted"`
+	Age      string    `json:"age"`
+}
+
+// adminConns lists the open connections of all rules as of now.
+func adminConns(rules []ruleConns, now time.Time) []connJSON {
+	out := []connJSON{}
+	for _, rc := range rules {
+		for _, c := range rc.conns {
+			out = append(out, connJSON{
+				ID:       c.ID,
+				Source:   rc.rule.Source,
+				Client:   c.Client,
+				Target:   c.Target,
+				BytesIn:  c.BytesIn,
+				BytesOut: c.BytesOut,
+				Accepted: c.Accepted,
+				Age:      now.Sub(c.Accepted).Round(time.Millisecond).String(),
+			})
+		}
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maikirakiwi/goportforward/forward"
+)
+
+// Duration is a time.Duration that reads and writes JSON as a string such
+// as "10s" or "1m30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Routes maps server names, or protocols, to targets. It is kept as a
+// sorted "name=targets" list, one per line, so that Rule stays
+// comparable; in JSON it is an object and on the command line each
+// -sni-route or -protocol-route adds one entry.
+type Routes string
+
+func (r Routes) entries() map[string]string {
+	m := make(map[string]string)
+	for _, line := range strings.Split(string(r), "\n") {
+		if name, targets, ok := strings.Cut(line, "="); ok {
+			m[name] = targets
+		}
+	}
+	return m
+}
+
+func (r *Routes) setEntries(m map[string]string) error {
+	lines := make([]string, 0, len(m))
+	for name, targets := range m {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || strings.ContainsAny(name, "=\n") {
+			return fmt.Errorf("invalid route name %q", name)
+		}
+		if len(forward.SplitTargets(targets)) == 0 {
+			return fmt.Errorf("no targets for route %s", name)
+		}
+		lines = append(lines, name+"="+targets)
+	}
+	slices.Sort(lines)
+	*r = Routes(strings.Join(lines, "\n"))
+	return nil
+}
+
+// Targets returns the targets of each server name.
+func (r Routes) Targets() map[string][]string {
+	if r == "" {
+		return nil
+	}
+	m := make(map[string][]string)
+	for name, targets := range r.entries() {
+		m[name] = forward.SplitTargets(targets)
+	}
+	return m
+}
+
+func (r Routes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.entries())
+}
+
+func (r *Routes) UnmarshalJSON(b []byte) error {
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("routes must map names to targets: %v", err)
+	}
+	return r.setEntries(m)
+}
+
+func (r *Routes) String() string {
+	if r == nil {
+		return ""
+	}
+	return strings.ReplaceAll(string(*r), "\n", " ")
+}
+
+// Set adds one "name=targets" entry, implementing flag.Value.
+func (r *Routes) Set(v string) error {
+	name, targets, ok := strings.Cut(v, "=")
+	if !ok {
+		return errors.New("want name=targets")
+	}
+	m := r.entries()
+	m[strings.ToLower(strings.TrimSpace(name))] = targets
+	return r.setEntries(m)
+}
+
+// Rule describes a single forward. The command-line flags fill in one Rule;
+// entries in a -config file start from those flag values and override
+// whatever fields they set.
+type Rule struct {
+	Protocol        string   `json:"protocol"`
+	Source          string   `json:"source"`
+	Target          string   `json:"target"`
+	SourceType      string   `json:"source_type,omitempty"`
+	TargetType      string   `json:"target_type,omitempty"`
+	Family          string   `json:"family,omitempty"`
+	DialTimeout     Duration `json:"dial_timeout"`
+	DialRetries     int      `json:"dial_retries"`
+	DialRetryDelay  Duration `json:"dial_retry_delay"`
+	RejectMessage   string   `json:"reject_message,omitempty"`
+	DNSTTL          Duration `json:"dns_ttl"`
+	FallbackDelay   Duration `json:"dial_fallback_delay"`
+	DialSource      string   `json:"dial_source,omitempty"`
+	SOCKS5          string   `json:"socks5,omitempty"`
+	LBStrategy      string   `json:"lb_strategy,omitempty"`
+	HTTPProxy       string   `json:"http_proxy,omitempty"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	UDPTimeout      Duration `json:"udp_timeout"`
+	IdleTimeout     Duration `json:"idle_timeout"`
+	MaxLifetime     Duration `json:"max_lifetime"`
+	ReconnectTarget int      `json:"reconnect_target"`
+	ReadTimeout     Duration `json:"read_timeout"`
+	WriteTimeout    Duration `json:"write_timeout"`
+	MaxFails        int      `json:"max_fails"`
+	FailTimeout     Duration `json:"fail_timeout"`
+	HealthInterval  Duration `json:"health_interval"`
+	HealthTimeout   Duration `json:"health_timeout"`
+	LatencyInterval Duration `json:"latency_interval"`
+	LatencyWindow   Duration `json:"latency_window"`
+	StatsInterval   Duration `json:"stats_interval"`
+	RateLimit       int64    `json:"rate_limit"`
+	GlobalRateLimit int64    `json:"global_rate_limit"`
+	UploadRate      int64    `json:"upload_rate"`
+	DownloadRate    int64    `json:"download_rate"`
+	MaxConns        int      `json:"max_conns"`
+	MaxConnsWait    bool     `json:"max_conns_wait"`
+	QueueTimeout    Duration `json:"queue_timeout"`
+	MaxConnsPerIP   int      `json:"max_conns_per_ip"`
+	AcceptRate      int      `json:"accept_rate"`
+	Allow           string   `json:"allow,omitempty"`
+	Deny            string   `json:"deny,omitempty"`
+	ProxyProtocol   string   `json:"proxy_protocol,omitempty"`
+
+	AcceptProxyProtocol   bool `json:"accept_proxy_protocol"`
+	ProxyProtocolOptional bool `json:"proxy_protocol_optional"`
+
+	TLSCert       string `json:"tls_cert,omitempty"`
+	TLSKey        string `json:"tls_key,omitempty"`
+	TLSMinVersion string `json:"tls_min_version,omitempty"`
+	TLSClientCA   string `json:"tls_client_ca,omitempty"`
+
+	TargetTLS           bool   `json:"target_tls"`
+	TargetTLSServerName string `json:"target_tls_servername,omitempty"`
+	TargetTLSInsecure   bool   `json:"target_tls_insecure"`
+	TargetTLSCert       string `json:"target_tls_cert,omitempty"`
+	TargetTLSKey        string `json:"target_tls_key,omitempty"`
+
+	SNIRoutes      Routes `json:"sni_routes,omitempty"`
+	ProtocolRoutes Routes `json:"protocol_routes,omitempty"`
+
+	Mirror string `json:"mirror,omitempty"`
+
+	CaptureDir      string `json:"capture_dir,omitempty"`
+	CaptureFormat   string `json:"capture_format,omitempty"`
+	CaptureMaxBytes int64  `json:"capture_max_bytes"`
+
+	Compress   string `json:"compress,omitempty"`
+	Decompress string `json:"decompress,omitempty"`
+
+	KeepAlive       bool     `json:"keepalive"`
+	KeepAlivePeriod Duration `json:"keepalive_period"`
+	TCPUserTimeout  Duration `json:"tcp_user_timeout"`
+	Linger          int      `json:"linger"`
+
+	RecvBuffer       int   `json:"rcvbuf"`
+	SendBuffer       int   `json:"sndbuf"`
+	BufferSize       int   `json:"buffer_size"`
+	MaxBufferedBytes int64 `json:"max_buffered_bytes"`
+
+	ReusePort bool `json:"reuseport"`
+	MPTCP     bool `json:"mptcp"`
+	Backlog   int  `json:"backlog"`
+
+	StrictOptimize bool `json:"strict_optimize"`
+	NoOptimize     bool `json:"no_optimize"`
+
+	Transparent bool `json:"transparent"`
+
+	UnixMode  string `json:"unix_mode,omitempty"`
+	UnixOwner string `json:"unix_owner,omitempty"`
+	UnixGroup string `json:"unix_group,omitempty"`
+	PeerCred  bool   `json:"peer_cred"`
+
+	DSCP int `json:"dscp"`
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("%s %s -> %s", r.Protocol, r.Source, r.Target)
+}
+
+// config is the layout of the -config file.
+type config struct {
+	Rules []json.RawMessage `json:"rules"`
+}
+
+// loadConfig reads the rules in path, using defaults for any field a rule
+// leaves out.
+func loadConfig(path string, defaults Rule) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+	if len(cfg.Rules) == 0 {
+		return nil, fmt.Errorf("config %s has no rules", path)
+	}
+
+	defaults.Source, defaults.Target = "", ""
+	rules := make([]Rule, 0, len(cfg.Rules))
+	for i, raw := range cfg.Rules {
+		r := defaults
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// ruleSpecs collects the source=targets pairs given with -rule,
+// implementing flag.Value.
+type ruleSpecs []string
+
+func (s *ruleSpecs) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, " ")
+}
+
+// Set adds the source=targets pairs in v, which may hold several
+// separated by spaces, e.g. to pass them all in one environment variable.
+func (s *ruleSpecs) Set(v string) error {
+	pairs := strings.Fields(v)
+	if len(pairs) == 0 {
+		return errors.New("want source=targets")
+	}
+	for _, pair := range pairs {
+		source, targets, ok := strings.Cut(pair, "=")
+		if !ok || source == "" || targets == "" {
+			return fmt.Errorf("invalid rule %q: want source=targets", pair)
+		}
+	}
+	*s = append(*s, pairs...)
+	return nil
+}
+
+// inlineRules returns a rule for each -rule pair in specs, with the rest
+// of its settings from defaults, like the rules of a config file.
+func inlineRules(specs ruleSpecs, defaults Rule) []Rule {
+	rules := make([]Rule, 0, len(specs))
+	for _, spec := range specs {
+		r := defaults
+		r.Source, r.Target, _ = strings.Cut(spec, "=")
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// Upper bounds for the buffer size settings, well beyond anything useful
+// but low enough to catch a misplaced unit.
+const (
+	maxSocketBuffer = 256 << 20
+	maxBufferSize   = 16 << 20
+)
+
+// checkSize reports an error naming the setting name unless v is
+// between 0 and max.
+func checkSize(name string, v, max int) error {
+	if v < 0 || v > max {
+		return fmt.Errorf("%s must be between 0 and %d bytes, got %d", name, max, v)
+	}
+	return nil
+}
+
+// newForwarder validates r and builds the Forwarder for it.
+func newForwarder(r Rule) (*forward.Forwarder, error) {
+	if r.Source == "" || (r.Target == "" && !r.Transparent) {
+		return nil, errors.New("both source and target addresses must be specified")
+	}
+
+	f := forward.NewForwarder(r.Source, r.Target)
+	proto, err := forward.ParseProtocol(r.Protocol)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protocol: %v", err)
+	}
+	f.Protocol = proto
+	f.DialTimeout = time.Duration(r.DialTimeout)
+	if r.DialRetries < 0 {
+		return nil, errors.New("dial retries must not be negative")
+	}
+	if r.DialRetries > 0 && r.DialRetryDelay <= 0 {
+		return nil, errors.New("dial retry delay must be positive")
+	}
+	f.DialRetries = r.DialRetries
+	f.DialRetryDelay = time.Duration(r.DialRetryDelay)
+	f.RejectMessage = r.RejectMessage
+	f.DNSTTL = time.Duration(r.DNSTTL)
+	if r.DialSource != "" {
+		if f.DialSource, err = netip.ParseAddr(r.DialSource); err != nil {
+			return nil, fmt.Errorf("invalid dial source: %v", err)
+		}
+	}
+	if r.SOCKS5 != "" {
+		if f.SOCKS5, f.SOCKS5User, f.SOCKS5Password, err = parseProxy("SOCKS5", "socks5", r.SOCKS5); err != nil {
+			return nil, err
+		}
+	}
+	if r.HTTPProxy != "" {
+		if f.HTTPProxy, f.HTTPProxyUser, f.HTTPProxyPassword, err = parseProxy("HTTP", "http", r.HTTPProxy); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case r.FallbackDelay < 0:
+		return nil, errors.New("dial fallback delay must not be negative")
+	case r.FallbackDelay == 0:
+		f.DialFallbackDelay = -1 // 0 turns Happy Eyeballs off here
+	default:
+		f.DialFallbackDelay = time.Duration(r.FallbackDelay)
+	}
+	if f.LBStrategy, err = forward.ParseLBStrategy(r.LBStrategy); err != nil {
+		return nil, err
+	}
+	f.ShutdownTimeout = time.Duration(r.ShutdownTimeout)
+	if f.Protocol == "udp" && r.UDPTimeout <= 0 {
+		return nil, fmt.Errorf("UDP timeout must be positive, got %s", time.Duration(r.UDPTimeout))
+	}
+	f.UDPTimeout = time.Duration(r.UDPTimeout)
+	f.IdleTimeout = time.Duration(r.IdleTimeout)
+	f.MaxLifetime = time.Duration(r.MaxLifetime)
+	if r.ReconnectTarget < 0 {
+		return nil, errors.New("reconnect target count must not be negative")
+	}
+	f.ReconnectTarget = r.ReconnectTarget
+	f.ReadTimeout = time.Duration(r.ReadTimeout)
+	f.WriteTimeout = time.Duration(r.WriteTimeout)
+	f.MaxFails = r.MaxFails
+	f.FailTimeout = time.Duration(r.FailTimeout)
+	f.HealthInterval = time.Duration(r.HealthInterval)
+	f.HealthTimeout = time.Duration(r.HealthTimeout)
+	f.LatencyInterval = time.Duration(r.LatencyInterval)
+	f.LatencyWindow = time.Duration(r.LatencyWindow)
+	f.StatsInterval = time.Duration(r.StatsInterval)
+	if r.RateLimit < 0 || r.GlobalRateLimit < 0 || r.UploadRate < 0 || r.DownloadRate < 0 || r.AcceptRate < 0 {
+		return nil, errors.New("rate limits must not be negative")
+	}
+	f.AcceptRate = r.AcceptRate
+	f.RateLimit = r.RateLimit
+	f.GlobalRateLimit = r.GlobalRateLimit
+	f.UploadRate = r.UploadRate
+	f.DownloadRate = r.DownloadRate
+	f.MaxConns = r.MaxConns
+	f.MaxConnsWait = r.MaxConnsWait
+	switch {
+	case r.QueueTimeout < 0:
+		return nil, errors.New("queue timeout must not be negative")
+	case r.QueueTimeout > 0 && r.MaxConns == 0:
+		return nil, errors.New("-queue-timeout requires -max-conns")
+	case r.QueueTimeout > 0 && r.MaxConnsWait:
+		return nil, errors.New("-queue-timeout and -max-conns-wait cannot be combined")
+	}
+	f.QueueTimeout = time.Duration(r.QueueTimeout)
+	f.MaxConnsPerIP = r.MaxConnsPerIP
+	if f.Allow, err = forward.ParseCIDRs(r.Allow); err != nil {
+		return nil, fmt.Errorf("invalid allow list: %v", err)
+	}
+	if f.Deny, err = forward.ParseCIDRs(r.Deny); err != nil {
+		return nil, fmt.Errorf("invalid deny list: %v", err)
+	}
+	if f.ProxyProtocol, err = forward.ParseProxyProtocol(r.ProxyProtocol); err != nil {
+		return nil, err
+	}
+	f.AcceptProxyProtocol = r.AcceptProxyProtocol
+	f.ProxyProtocolOptional = r.ProxyProtocolOptional
+	if f.TLSConfig, err = serverTLSConfig(r); err != nil {
+		return nil, err
+	}
+	if f.TargetTLSConfig, err = targetTLSConfig(r); err != nil {
+		return nil, err
+	}
+	f.SNIRoutes = r.SNIRoutes.Targets()
+	f.ProtocolRoutes = r.ProtocolRoutes.Targets()
+	for protocol := range f.ProtocolRoutes {
+		if _, err := forward.ParseSniffProtocol(protocol); err != nil {
+			return nil, fmt.Errorf("-protocol-route: %v", err)
+		}
+	}
+	f.Mirror = r.Mirror
+	f.CaptureDir = r.CaptureDir
+	if f.CaptureFormat, err = forward.ParseCaptureFormat(r.CaptureFormat); err != nil {
+		return nil, err
+	}
+	switch {
+	case r.CaptureMaxBytes < 0:
+		return nil, errors.New("capture max bytes must not be negative")
+	case r.CaptureMaxBytes == 0:
+		f.CaptureMaxBytes = -1 // 0 means no limit here
+	default:
+		f.CaptureMaxBytes = r.CaptureMaxBytes
+	}
+	if f.Compress, err = forward.ParseCompression(r.Compress); err != nil {
+		return nil, err
+	}
+	if f.Decompress, err = forward.ParseCompression(r.Decompress); err != nil {
+		return nil, err
+	}
+	f.KeepAlive = 0
+	if r.KeepAlive {
+		if r.KeepAlivePeriod <= 0 {
+			return nil, errors.New("keepalive period must be positive")
+		}
+		f.KeepAlive = time.Duration(r.KeepAlivePeriod)
+	}
+	if r.TCPUserTimeout < 0 || (r.TCPUserTimeout > 0 && time.Duration(r.TCPUserTimeout) < time.Millisecond) {
+		return nil, errors.New("TCP user timeout must be 0 or at least 1ms")
+	}
+	f.TCPUserTimeout = time.Duration(r.TCPUserTimeout)
+	if r.Linger < -1 {
+		return nil, fmt.Errorf("-linger must be -1 or more, got %d", r.Linger)
+	}
+	f.Linger = r.Linger
+	if err := checkSize("-rcvbuf", r.RecvBuffer, maxSocketBuffer); err != nil {
+		return nil, err
+	}
+	if err := checkSize("-sndbuf", r.SendBuffer, maxSocketBuffer); err != nil {
+		return nil, err
+	}
+	if err := checkSize("-buffer-size", r.BufferSize, maxBufferSize); err != nil {
+		return nil, err
+	}
+	f.RecvBuffer = r.RecvBuffer
+	f.SendBuffer = r.SendBuffer
+	f.BufferSize = r.BufferSize
+	if r.MaxBufferedBytes < 0 {
+		return nil, errors.New("max buffered bytes must not be negative")
+	}
+	f.MaxBufferedBytes = r.MaxBufferedBytes
+	f.ReusePort = r.ReusePort
+	if r.Backlog < 0 {
+		return nil, errors.New("backlog must not be negative")
+	}
+	f.Backlog = r.Backlog
+	f.MPTCP = r.MPTCP
+	if r.NoOptimize && r.StrictOptimize {
+		return nil, errors.New("-no-optimize and -strict-optimize cannot be combined")
+	}
+	f.StrictOptimize = r.StrictOptimize
+	f.NoOptimize = r.NoOptimize
+	f.Transparent = r.Transparent
+	if r.DSCP < 0 || r.DSCP > 63 {
+		return nil, fmt.Errorf("-dscp must be between 0 and 63, got %d", r.DSCP)
+	}
+	f.DSCP = r.DSCP
+	if r.UnixMode != "" {
+		mode, err := strconv.ParseUint(r.UnixMode, 8, 32)
+		if err != nil || mode > 0o777 {
+			return nil, fmt.Errorf("invalid unix mode %q: want octal permissions such as 0660", r.UnixMode)
+		}
+		f.UnixMode = os.FileMode(mode)
+	}
+	f.UnixOwner = r.UnixOwner
+	f.UnixGroup = r.UnixGroup
+	f.PeerCred = r.PeerCred
+	if r.SourceType != "" {
+		network, err := forward.ParseNetworkType(r.SourceType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source type: %v", err)
+		}
+		f.SourceNetwork = network
+	}
+	if f.Family, err = forward.ParseFamily(r.Family); err != nil {
+		return nil, err
+	}
+	if r.TargetType != "" {
+		network, err := forward.ParseNetworkType(r.TargetType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target type: %v", err)
+		}
+		f.TargetNetwork = network
+	}
+	return f, nil
+}
+
+// parseProxy splits a -socks5 or -http-proxy value of the form
+// [scheme://][user:password@]host:port into the proxy address and its
+// credentials. Special characters in the credentials can be
+// percent-encoded.
+func parseProxy(kind, scheme, s string) (addr, user, password string, err error) {
+	rest, _ := strings.CutPrefix(s, scheme+"://")
+	u, err := url.Parse(scheme + "://" + rest)
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid %s proxy %q: %v", kind, s, err)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil || (u.Path != "" && u.Path != "/") {
+		return "", "", "", fmt.Errorf("invalid %s proxy %q: want [%s://][user:password@]host:port", kind, s, scheme)
+	}
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	return u.Host, user, password, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// controlIdleTimeout closes control connections that send no command for
+// this long.
+const controlIdleTimeout = 5 * time.Minute
+
+const controlHelp = `show stat   traffic counters of every rule, as CSV
+show conn   open TCP connections, as CSV
+shutdown    stop accepting, drain connections and exit
+help        this list
+quit        close the control connection
+`
+
+// startControl serves text commands for sup on a Unix socket at path
+// until ctx is done. The shutdown command calls shutdown.
+func startControl(ctx context.Context, path string, sup *supervisor, shutdown func()) error {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("refusing to replace %s with the control socket: not a socket", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to start control socket: %v", err)
+	}
+	// The socket can shut the process down, so only its owner may use it
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return fmt.Errorf("failed to restrict control socket: %v", err)
+	}
+	context.AfterFunc(ctx, func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("Control socket failed", "error", err)
+				}
+				return
+			}
+			go serveControl(conn, sup, shutdown)
+		}
+	}()
+	slog.Info("Serving control socket", "path", path)
+	return nil
+}
+
+// serveControl answers the commands sent on conn, one per line, until the
+// client hangs up or quits.
+func serveControl(conn net.Conn, sup *supervisor, shutdown func()) {
+	defer conn.Close()
+	lines := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(controlIdleTimeout))
+		if !lines.Scan() {
+			return
+		}
+		cmd := strings.Join(strings.Fields(lines.Text()), " ")
+		switch cmd {
+		case "":
+			continue
+		case "show stat":
+			writeStatCSV(conn, sup.stats())
+		case "show conn":
+			writeConnCSV(conn, sup.conns(), time.Now())
+		case "shutdown":
+			slog.Info("Shutting down on control socket command")
+			io.WriteString(conn, "Shutting down\n")
+			shutdown()
+			return
+		case "help":
+			io.WriteString(conn, controlHelp)
+		case "quit":
+			return
+		default:
+			fmt.Fprintf(conn, "Unknown command %q, try help\n", cmd)
+		}
+		// An empty line ends each answer, as in HAProxy
+		io.WriteString(conn, "\n")
+	}
+}
+
+func writeStatCSV(w io.Writer, stats []ruleStats) {
+	io.WriteString(w, "# ")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"protocol", "source", "target", "accepted", "failed", "active", "bytes_sent", "bytes_received"})
+	for _, rs := range stats {
+		cw.Write([]string{
+			rs.rule.Protocol, rs.rule.Source, rs.rule.Target,
+			strconv.FormatUint(rs.stats.Accepted, 10),
+			strconv.FormatUint(rs.stats.Failed, 10),
+			strconv.FormatInt(rs.stats.Active, 10),
+			strconv.FormatUint(rs.stats.BytesSent, 10),
+			strconv.FormatUint(rs.stats.BytesReceived, 10),
+		})
+	}
+	cw.Flush()
+}
+
+func writeConnCSV(w io.Writer, rules []ruleConns, now time.Time) {
+	io.WriteString(w, "# ")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "source", "client", "target", "bytes_in", "bytes_out", "age"})
+	for _, rc := range rules {
+		for _, c := range rc.conns {
+			cw.Write([]string{
+				strconv.FormatUint(c.ID, 10), rc.rule.Source, c.Client, c.Target,
+				strconv.FormatInt(c.BytesIn, 10),
+				strconv.FormatInt(c.BytesOut, 10),
+				now.Sub(c.Accepted).Round(time.Millisecond).String(),
+			})
+		}
+	}
+	cw.Flush()
+}
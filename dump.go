@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// handleDumpSignal logs sup's open connections each time the process gets
+// SIGUSR1, until ctx is done. It does nothing where there is no SIGUSR1.
+func handleDumpSignal(ctx context.Context, sup *supervisor) {
+	if dumpSignal == nil {
+		return
+	}
+	usr := make(chan os.Signal, 1)
+	signal.Notify(usr, dumpSignal)
+	go func() {
+		defer signal.Stop(usr)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-usr:
+			}
+			dumpConns(sup.conns(), time.Now())
+		}
+	}()
+}
+
+// dumpConns logs every connection of rules, as open at now, between a
+// line that counts them and one that ends the dump.
+func dumpConns(rules []ruleConns, now time.Time) {
+	n := 0
+	for _, rc := range rules {
+		n += len(rc.conns)
+	}
+	slog.Info("Dumping open connections", "count", n)
+	for _, rc := range rules {
+		for _, c := range rc.conns {
+			slog.Info("Open connection", "conn", c.ID, "source", rc.rule.Source, "client", c.Client,
+				"target", c.Target, "bytes_in", c.BytesIn, "bytes_out", c.BytesOut,
+				"age", now.Sub(c.Accepted).Round(time.Millisecond))
+		}
+	}
+	slog.Info("End of open connections")
+}
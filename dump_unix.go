@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignal makes the process log its open connections.
+var dumpSignal os.Signal = syscall.SIGUSR1
@@ -0,0 +1,69 @@
+package forward
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// ParseCIDRs parses a comma-separated list of CIDR blocks such as
+// "10.0.0.0/8,192.168.1.0/24". A bare IP is taken as a single-host block.
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP or CIDR %q", part)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func matchCIDRs(nets []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return n
+		}
+	}
+	return nil
+}
+
+// allowed checks conn's client IP against Deny and then Allow. Clients
+// without an IP, such as on Unix sockets, are always allowed.
+func (f *Forwarder) allowed(conn net.Conn, logger *slog.Logger) bool {
+	if len(f.Allow) == 0 && len(f.Deny) == 0 {
+		return true
+	}
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+
+	if n := matchCIDRs(f.Deny, tcpAddr.IP); n != nil {
+		logger.Warn("Rejecting connection: denied", "client", tcpAddr.IP.String(), "cidr", n.String())
+		return false
+	}
+	if len(f.Allow) > 0 && matchCIDRs(f.Allow, tcpAddr.IP) == nil {
+		logger.Warn("Rejecting connection: not in allow list", "client", tcpAddr.IP.String())
+		return false
+	}
+	return true
+}
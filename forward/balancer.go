@@ -0,0 +1,296 @@
+package forward
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load balancing strategies for Forwarder.LBStrategy.
+const (
+	RoundRobin = "round-robin"
+	LeastConn  = "least-conn"
+	Sticky     = "sticky"
+)
+
+// ParseLBStrategy validates a strategy name for Forwarder.LBStrategy;
+// empty means RoundRobin.
+func ParseLBStrategy(s string) (string, error) {
+	switch s {
+	case "", RoundRobin:
+		return RoundRobin, nil
+	case LeastConn, Sticky:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown load balancing strategy %q (want round-robin, least-conn or sticky)", s)
+	}
+}
+
+// backend is one target address a Forwarder can dial.
+type backend struct {
+	addr    string
+	network string
+	weight  int
+	current int // smooth weighted round-robin state, guarded by balancer.mu
+
+	unhealthy atomic.Bool  // set by the active health probe
+	active    atomic.Int64 // open connections or UDP sessions
+
+	mu        sync.Mutex
+	fails     int       // consecutive failed dials
+	downUntil time.Time // non-zero while ejected from the rotation
+}
+
+// available reports whether b may receive new connections, re-admitting
+// it, and logging that to logger, once its ejection has run out.
+func (b *backend) available(now time.Time, logger *slog.Logger) bool {
+	if b.unhealthy.Load() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.downUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.downUntil) {
+		return false
+	}
+	b.downUntil = time.Time{}
+	logger.Info("Target re-admitted to rotation", "target", b.addr)
+	return true
+}
+
+// balancer hands out backends in round-robin order, with LeastConn those
+// with the fewest active connections first, or with Sticky in an order
+// fixed per client IP. When maxFails is positive, a backend that fails
+// that many dials in a row is skipped for failTimeout.
+type balancer struct {
+	backends    []*backend
+	weighted    bool // some backend has a weight other than 1
+	strategy    string
+	next        atomic.Uint64
+	mu          sync.Mutex // serializes weighted round-robin picks
+	maxFails    int
+	failTimeout time.Duration
+	logger      *slog.Logger
+}
+
+// newBalancer builds a balancer over targets. An empty network means each
+// target's network is detected on its own.
+func newBalancer(targets []string, network string) (*balancer, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("no target addresses specified")
+	}
+	b := &balancer{}
+	for _, target := range targets {
+		addr, weight, err := splitWeight(target)
+		if err != nil {
+			return nil, err
+		}
+		n, addr := splitNetwork(addr, network)
+		b.backends = append(b.backends, &backend{addr: addr, network: n, weight: weight})
+		if weight != 1 {
+			b.weighted = true
+		}
+	}
+	return b, nil
+}
+
+// splitWeight splits a target of the form addr=weight into its parts. A
+// target without a numeric weight suffix has weight 1, so Unix socket
+// paths containing "=" still work.
+func splitWeight(target string) (string, int, error) {
+	i := strings.LastIndexByte(target, '=')
+	if i < 0 {
+		return target, 1, nil
+	}
+	w := target[i+1:]
+	if digits := strings.TrimPrefix(w, "-"); digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return target, 1, nil
+	}
+	weight, err := strconv.Atoi(w)
+	if err != nil || weight <= 0 {
+		return "", 0, fmt.Errorf("invalid weight for target %s: want a positive integer", target[:i])
+	}
+	return target[:i], weight, nil
+}
+
+// newBalancer builds a balancer over targets with f's network, family and
+// failure settings.
+func (f *Forwarder) newBalancer(targets []string) (*balancer, error) {
+	strategy, err := ParseLBStrategy(f.LBStrategy)
+	if err != nil {
+		return nil, err
+	}
+	b, err := newBalancer(targets, f.TargetNetwork)
+	if err != nil {
+		return nil, err
+	}
+	for _, be := range b.backends {
+		be.network = f.withFamily(be.network)
+	}
+	b.strategy = strategy
+	b.maxFails, b.failTimeout = f.MaxFails, f.FailTimeout
+	b.logger = f.logger
+	return b, nil
+}
+
+// order returns the available backends, starting with the next one in
+// rotation, in the order they should be tried for a connection from the
+// client IP key, which is empty if the client has none. Weighted
+// backends are picked by smooth weighted round-robin. With LeastConn they
+// are sorted by their active connections per unit of weight, ties keeping
+// the round-robin order. With Sticky and a key they are ranked by
+// rendezvous hashing, so a client always gets the same backend, and
+// adding or removing one only moves the clients that backend wins or
+// loses. If every backend is ejected or unhealthy they are all returned
+// rather than none.
+func (b *balancer) order(key string) []*backend {
+	n := uint64(len(b.backends))
+	start := b.next.Add(1) - 1
+	now := time.Now()
+
+	all := make([]*backend, n)
+	out := make([]*backend, 0, n)
+	for i := range all {
+		be := b.backends[(start+uint64(i))%n]
+		all[i] = be
+		if be.available(now, b.logger) {
+			out = append(out, be)
+		}
+	}
+	if len(out) == 0 {
+		out = all
+	}
+	switch {
+	case b.strategy == LeastConn:
+		// Ties keep the order from before sorting, which follows the
+		// weights too
+		if b.weighted {
+			b.pickWeighted(out)
+		}
+		// Counts change under us; sort by a snapshot. Comparing
+		// active/weight is done by cross-multiplying.
+		active := make(map[*backend]int64, len(out))
+		for _, be := range out {
+			active[be] = be.active.Load()
+		}
+		slices.SortStableFunc(out, func(x, y *backend) int {
+			return cmp.Compare(active[x]*int64(y.weight), active[y]*int64(x.weight))
+		})
+	case b.strategy == Sticky && key != "":
+		scores := make(map[*backend]float64, len(out))
+		for _, be := range out {
+			scores[be] = stickyScore(key, be.addr, be.weight)
+		}
+		slices.SortFunc(out, func(x, y *backend) int {
+			return cmp.Or(cmp.Compare(scores[y], scores[x]), strings.Compare(x.addr, y.addr))
+		})
+	case b.weighted:
+		b.pickWeighted(out)
+	}
+	return out
+}
+
+// pickWeighted moves the backend picked by smooth weighted round-robin,
+// as in nginx, to the front of backends. Over any stretch of picks each
+// backend is chosen in proportion to its weight, and spread out rather
+// than in bursts. Only the backends passed in take part, so one that is
+// ejected or unhealthy does not get picked.
+func (b *balancer) pickWeighted(backends []*backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total, best := 0, 0
+	for i, be := range backends {
+		be.current += be.weight
+		total += be.weight
+		if be.current > backends[best].current {
+			best = i
+		}
+	}
+	backends[best].current -= total
+	// Keep the rotation order for the fallbacks
+	picked := backends[best]
+	copy(backends[1:best+1], backends[:best])
+	backends[0] = picked
+}
+
+// stickyScore is the rendezvous hashing score of the backend at addr
+// with weight for the client IP key; a backend wins a share of clients
+// proportional to its weight. It only depends on its arguments, so
+// clients keep their backend across restarts too.
+func stickyScore(key, addr string, weight int) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(addr))
+	// FNV spreads similar inputs poorly on its own; finish with the
+	// SplitMix64 mixer
+	x := h.Sum64()
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	// Weighted rendezvous hashing: weight / -ln(u), u uniform in (0, 1)
+	u := (float64(x>>11) + 0.5) / (1 << 53)
+	return float64(weight) / -math.Log(u)
+}
+
+// markFailure records a failed dial to be, ejecting it once it reaches
+// maxFails consecutive failures.
+func (b *balancer) markFailure(be *backend) {
+	if b.maxFails <= 0 {
+		return
+	}
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	be.fails++
+	if be.fails >= b.maxFails && be.downUntil.IsZero() {
+		be.downUntil = time.Now().Add(b.failTimeout)
+		b.logger.Warn("Target is down, ejecting", "target", be.addr, "failures", be.fails, "duration", b.failTimeout)
+	}
+}
+
+// markSuccess records a successful dial to be.
+func (b *balancer) markSuccess(be *backend) {
+	if b.maxFails <= 0 {
+		return
+	}
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if be.fails >= b.maxFails {
+		b.logger.Info("Target is back up", "target", be.addr)
+	}
+	be.fails = 0
+}
+
+func (b *balancer) String() string {
+	parts := make([]string, len(b.backends))
+	for i, be := range b.backends {
+		parts[i] = be.addr + " (" + be.network + ")"
+		if b.weighted {
+			parts[i] = be.addr + " (" + be.network + ", weight " + strconv.Itoa(be.weight) + ")"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// SplitTargets splits a comma-separated target list, dropping empty
+// entries and surrounding whitespace.
+func SplitTargets(s string) []string {
+	var targets []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
@@ -0,0 +1,179 @@
+package forward
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultCaptureMaxBytes is the size at which a capture file stops
+// growing when CaptureMaxBytes is not set.
+const DefaultCaptureMaxBytes = 64 << 20
+
+// Capture formats: raw files hold the bytes as they were forwarded,
+// framed ones prefix each read with its length as a 4-byte big-endian
+// integer, so the boundaries of the original reads are preserved.
+const (
+	CaptureRaw    = "raw"
+	CaptureFramed = "framed"
+)
+
+// ParseCaptureFormat validates a capture format name; empty means raw.
+func ParseCaptureFormat(s string) (string, error) {
+	switch s {
+	case "", CaptureRaw:
+		return CaptureRaw, nil
+	case CaptureFramed:
+		return CaptureFramed, nil
+	default:
+		return "", fmt.Errorf("invalid capture format %q (want raw or framed)", s)
+	}
+}
+
+// checkCaptureDir reports whether CaptureDir is usable, so that a missing
+// directory fails at startup rather than on every connection.
+func (f *Forwarder) checkCaptureDir() error {
+	if f.CaptureDir == "" {
+		return nil
+	}
+	if _, err := ParseCaptureFormat(f.CaptureFormat); err != nil {
+		return err
+	}
+	fi, err := os.Stat(f.CaptureDir)
+	if err != nil {
+		return fmt.Errorf("capture directory: %v", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("capture directory: %s is not a directory", f.CaptureDir)
+	}
+	return nil
+}
+
+// captureFile records one direction of a connection. Capturing never
+// disturbs the forwarded stream: Write always reports success, and a
+// file that fails or reaches its size limit silently stops growing after
+// a warning.
+type captureFile struct {
+	logger *slog.Logger
+	file   *os.File
+	w      *bufio.Writer
+	left   int64 // bytes that may still be written
+	framed bool
+	done   bool // stopped recording
+}
+
+// openCapture creates the capture files for the two directions of the
+// connection ci from client. They are named after the time the
+// connection was accepted, its ID, the client address and the direction.
+func (f *Forwarder) openCapture(ci connInfo, client net.Addr) (sent, received *captureFile, err error) {
+	format, err := ParseCaptureFormat(f.CaptureFormat)
+	if err != nil {
+		return nil, nil, err
+	}
+	limit := f.CaptureMaxBytes
+	switch {
+	case limit == 0:
+		limit = DefaultCaptureMaxBytes
+	case limit < 0:
+		limit = math.MaxInt64
+	}
+	prefix := fmt.Sprintf("%s-%d-%s", ci.accepted.UTC().Format("20060102T150405"), ci.id, captureName(client))
+	open := func(direction string) (*captureFile, error) {
+		name := filepath.Join(f.CaptureDir, prefix+"-"+direction+"."+format)
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		return &captureFile{
+			logger: ci.logger.With("capture", name),
+			file:   file,
+			w:      bufio.NewWriter(file),
+			left:   limit,
+			framed: format == CaptureFramed,
+		}, nil
+	}
+	if sent, err = open("sent"); err != nil {
+		return nil, nil, err
+	}
+	if received, err = open("received"); err != nil {
+		sent.Close()
+		return nil, nil, err
+	}
+	return sent, received, nil
+}
+
+// captureName turns a client address into something safe to put in a
+// file name.
+func captureName(addr net.Addr) string {
+	s := ""
+	if addr != nil {
+		s = addr.String()
+	}
+	if s == "" {
+		return "local"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func (c *captureFile) Write(p []byte) (int, error) {
+	if c.done || len(p) == 0 {
+		return len(p), nil
+	}
+	data := p
+	if c.framed {
+		// Only whole frames are recorded, so the file stays parseable
+		if int64(4+len(p)) > c.left {
+			c.stop("Capture size limit reached, no longer recording", nil)
+			return len(p), nil
+		}
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(p)))
+		if _, err := c.w.Write(hdr[:]); err != nil {
+			c.stop("Failed to write capture file", err)
+			return len(p), nil
+		}
+		c.left -= 4
+	} else if int64(len(data)) > c.left {
+		data = data[:c.left]
+	}
+	if _, err := c.w.Write(data); err != nil {
+		c.stop("Failed to write capture file", err)
+		return len(p), nil
+	}
+	c.left -= int64(len(data))
+	if len(data) < len(p) {
+		c.stop("Capture size limit reached, no longer recording", nil)
+	}
+	return len(p), nil
+}
+
+// stop logs why recording ended and ignores further writes.
+func (c *captureFile) stop(msg string, err error) {
+	if err != nil {
+		c.logger.Warn(msg, "error", err)
+	} else {
+		c.logger.Warn(msg)
+	}
+	c.done = true
+}
+
+// Close flushes what was recorded and closes the file.
+func (c *captureFile) Close() error {
+	err := errors.Join(c.w.Flush(), c.file.Close())
+	if err != nil {
+		c.logger.Warn("Failed to close capture file", "error", err)
+	}
+	return err
+}
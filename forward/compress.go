@@ -0,0 +1,95 @@
+package forward
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compression algorithms for Compress and Decompress. Both produce
+// DEFLATE data; gzip adds a CRC-32 of the stream, so corruption is
+// detected, at the cost of a few bytes per connection.
+const (
+	CompressDeflate = "deflate"
+	CompressGzip    = "gzip"
+)
+
+// ParseCompression validates a compression algorithm name; empty and
+// "none" mean no compression and are returned as "".
+func ParseCompression(s string) (string, error) {
+	switch s {
+	case "", "none":
+		return "", nil
+	case CompressDeflate, CompressGzip:
+		return s, nil
+	default:
+		return "", fmt.Errorf("invalid compression %q (want deflate, gzip or none)", s)
+	}
+}
+
+// compressor is the part of flate.Writer and gzip.Writer that
+// compressWriter needs.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter compresses what is written to it with a compressor that
+// is flushed after every write, so that data reaches the peer as soon as
+// it would have without compression, at some cost in ratio for small
+// writes. Close writes the end of the stream.
+type compressWriter struct {
+	c compressor
+}
+
+func newCompressWriter(alg string, w io.Writer) *compressWriter {
+	if alg == CompressGzip {
+		return &compressWriter{c: gzip.NewWriter(w)}
+	}
+	c, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return &compressWriter{c: c}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	n, err := w.c.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.c.Flush()
+}
+
+func (w *compressWriter) Close() error {
+	return w.c.Close()
+}
+
+// decompressReader decompresses what it reads from r. The decompressor is
+// only created on the first read, as a gzip reader starts by reading the
+// header, which would block until the peer sends something. A peer that
+// closes without sending anything, e.g. a forwarder that could not reach
+// its target, gives a plain EOF rather than a truncated stream.
+type decompressReader struct {
+	alg string
+	r   io.Reader
+	d   io.Reader
+}
+
+func (r *decompressReader) Read(p []byte) (int, error) {
+	if r.d == nil {
+		br := bufio.NewReader(r.r)
+		if _, err := br.Peek(1); err != nil {
+			return 0, err
+		}
+		if r.alg == CompressGzip {
+			zr, err := gzip.NewReader(br)
+			if err != nil {
+				return 0, fmt.Errorf("reading compressed stream: %w", err)
+			}
+			r.d = zr
+		} else {
+			r.d = flate.NewReader(br)
+		}
+	}
+	return r.d.Read(p)
+}
@@ -0,0 +1,310 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// optimizeConn tunes a TCP connection for forwarding; other connections
+// are left alone. An option that cannot be set does not stop the others
+// from being tried; the errors are returned together. With NoOptimize it
+// does nothing.
+func (f *Forwarder) optimizeConn(conn net.Conn) error {
+	if f.NoOptimize {
+		return nil
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	var errs []error
+	// Disable Nagle's algorithm
+	if err := tcpConn.SetNoDelay(true); err != nil {
+		errs = append(errs, fmt.Errorf("failed to set TCP_NODELAY: %v", err))
+	}
+	// Set TCP keepalive. Go turns it on for every connection, so it has
+	// to be switched off explicitly when disabled.
+	if err := tcpConn.SetKeepAlive(f.KeepAlive > 0); err != nil {
+		errs = append(errs, fmt.Errorf("failed to set TCP keepalive: %v", err))
+	} else if f.KeepAlive > 0 {
+		if err := tcpConn.SetKeepAlivePeriod(f.KeepAlive); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set TCP keepalive period: %v", err))
+		}
+	}
+	if f.Linger >= 0 {
+		if err := tcpConn.SetLinger(f.Linger); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set SO_LINGER: %v", err))
+		}
+	}
+	if f.TCPUserTimeout > 0 && setUserTimeout != nil {
+		if err := setUserTimeout(tcpConn, f.TCPUserTimeout); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Size socket buffers for high throughput
+	if err := setSocketBuffers(tcpConn, f.RecvBuffer, f.SendBuffer); err != nil {
+		errs = append(errs, err)
+	}
+
+	if f.DSCP > 0 && setDSCP != nil {
+		if err := setDSCP(tcpConn, f.DSCP); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// usesMPTCP reports whether conn runs over Multipath TCP rather than
+// having fallen back to plain TCP.
+func usesMPTCP(conn net.Conn) bool {
+	tcpConn, ok := netConn(conn).(*net.TCPConn)
+	if !ok {
+		return false
+	}
+	ok, err := tcpConn.MultipathTCP()
+	return ok && err == nil
+}
+
+// copyBufferSize is the size of the buffer each direction of a TCP
+// connection is copied through.
+func (f *Forwarder) copyBufferSize() int64 {
+	if f.BufferSize <= 0 {
+		return 32 * 1024 // io.Copy's own
+	}
+	return int64(f.BufferSize)
+}
+
+// copy copies src to dst like io.Copy, through a BufferSize buffer from
+// f.buffers so busy forwarders do not allocate one per connection.
+func (f *Forwarder) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if f.BufferSize <= 0 {
+		return io.Copy(dst, src)
+	}
+	buf, _ := f.buffers.Get().(*[]byte)
+	if buf == nil || len(*buf) != f.BufferSize {
+		b := make([]byte, f.BufferSize)
+		buf = &b
+	}
+	defer f.buffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// idleTracker records when a connection last carried data in either
+// direction, for IdleTimeout.
+type idleTracker struct {
+	timeout time.Duration
+	last    atomic.Int64 // UnixNano of the latest read or write
+}
+
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	t := &idleTracker{timeout: timeout}
+	t.touch()
+	return t
+}
+
+func (t *idleTracker) touch() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+// activeUntil returns when the connection will have been idle for
+// timeout, and whether that is still to come.
+func (t *idleTracker) activeUntil() (time.Time, bool) {
+	until := time.Unix(0, t.last.Load()).Add(t.timeout)
+	return until, until.After(time.Now())
+}
+
+// idleReader reads from conn with a read deadline that every chunk of
+// data, read or written in either direction, pushes forward by the
+// tracker's timeout. When the deadline passes while the other direction
+// was busy, the read simply goes on, so a connection is only considered
+// idle once both directions have gone quiet. Deadlines are left alone
+// once ctx is done so cancellation sticks.
+type idleReader struct {
+	ctx  context.Context
+	conn net.Conn
+	idle *idleTracker
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.conn.Read(p)
+		if n > 0 {
+			r.idle.touch()
+			r.arm(time.Now().Add(r.idle.timeout))
+		}
+		if n == 0 && isTimeout(err) {
+			if until, active := r.idle.activeUntil(); active && r.arm(until) {
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+// arm sets the read deadline of r.conn to d and reports whether it did,
+// which it does not once ctx is done.
+func (r *idleReader) arm(d time.Time) bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+	r.conn.SetReadDeadline(d)
+	// Cancellation may have tripped the deadline in the meantime
+	if r.ctx.Err() != nil {
+		r.conn.SetReadDeadline(time.Now())
+		return false
+	}
+	return true
+}
+
+// idleWriter counts the data written to w as activity for an
+// idleTracker. A write that stalls because the peer stopped reading
+// does not count until some of it goes through.
+type idleWriter struct {
+	w    io.Writer
+	idle *idleTracker
+}
+
+func (w *idleWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.idle.touch()
+	}
+	return n, err
+}
+
+// copyFailure records the copy direction that failed first, and how.
+type copyFailure struct {
+	direction string // "upstream" or "downstream"
+	err       error
+}
+
+// opTimeout records which operation on which side of a connection ran
+// past ReadTimeout or WriteTimeout.
+type opTimeout struct {
+	err  error  // errReadTimeout or errWriteTimeout
+	peer string // "client" or "target"
+}
+
+// opTimer returns a stopped timer that, once it fires, stores t in fired
+// unless another one got there first and calls cancel.
+func opTimer(t *opTimeout, fired *atomic.Pointer[opTimeout], cancel context.CancelFunc) *time.Timer {
+	timer := time.AfterFunc(time.Hour, func() {
+		fired.CompareAndSwap(nil, t)
+		cancel()
+	})
+	timer.Stop()
+	return timer
+}
+
+// timeoutReader runs timer for timeout during every read from r, so a
+// read that waits longer fires it. Time spent elsewhere, such as writing
+// the data on or waiting for a rate limit, does not count.
+type timeoutReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.r.Read(p)
+	r.timer.Stop()
+	return n, err
+}
+
+// timeoutWriter runs timer for timeout during every write to w.
+type timeoutWriter struct {
+	w       io.Writer
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (w *timeoutWriter) Write(p []byte) (int, error) {
+	w.timer.Reset(w.timeout)
+	n, err := w.w.Write(p)
+	w.timer.Stop()
+	return n, err
+}
+
+// prefixConn is a net.Conn that replays prefix, bytes already read from
+// the underlying connection, before reading from it again. It can also
+// report different remote and local addresses, such as those taken from a
+// PROXY protocol header.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// WriteTo flushes the prefix and then lets io.Copy use the underlying
+// connection directly, keeping any kernel fast path available.
+func (c *prefixConn) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	if len(c.prefix) > 0 {
+		n, err := w.Write(c.prefix)
+		written += int64(n)
+		c.prefix = c.prefix[n:]
+		if err != nil {
+			return written, err
+		}
+	}
+	n, err := io.Copy(w, c.Conn)
+	return written + n, err
+}
+
+func (c *prefixConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *prefixConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *prefixConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// closeWrite half-closes the write side of conn so the peer sees EOF while
+// the other direction keeps flowing. Connections that cannot half-close,
+// such as those from net.Pipe, are closed outright; otherwise the peer
+// would never learn that this direction is done.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
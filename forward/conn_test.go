@@ -0,0 +1,35 @@
+package forward
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// BenchmarkCopy copies through the pooled buffer of BufferSize and
+// through io.Copy's own. With the pool, a copy should allocate next to
+// nothing, while io.Copy allocates its 32 KiB buffer every time.
+func BenchmarkCopy(b *testing.B) {
+	data := bytes.Repeat([]byte{'x'}, 1024*1024)
+	for _, bc := range []struct {
+		name string
+		size int
+	}{
+		{"pooled", DefaultBufferSize},
+		{"io.Copy", 0},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			f := &Forwarder{BufferSize: bc.size}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				// Hide WriterTo and ReaderFrom so the buffer is used
+				src := struct{ io.Reader }{bytes.NewReader(data)}
+				dst := struct{ io.Writer }{io.Discard}
+				if _, err := f.copy(dst, src); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
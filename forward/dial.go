@@ -0,0 +1,109 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Dialer opens connections to targets. *net.Dialer implements it; a
+// custom Dialer can route connections elsewhere, such as through a tunnel
+// or to in-memory connections in tests.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// dialer returns the Dialer to reach targets with, going through the
+// SOCKS5 or HTTP proxy if one is set.
+func (f *Forwarder) dialer() Dialer {
+	d := f.Dialer
+	if d == nil {
+		sd := &sourceDialer{
+			Dialer: net.Dialer{FallbackDelay: f.DialFallbackDelay},
+			source: f.DialSource,
+		}
+		if f.MPTCP {
+			sd.SetMultipathTCP(true)
+		}
+		d = sd
+	}
+	if f.SOCKS5 != "" {
+		d = &socks5Dialer{proxy: f.SOCKS5, user: f.SOCKS5User, password: f.SOCKS5Password, dialer: d}
+	} else if f.HTTPProxy != "" {
+		d = &httpProxyDialer{proxy: f.HTTPProxy, user: f.HTTPProxyUser, password: f.HTTPProxyPassword, dialer: d}
+	}
+	return d
+}
+
+// sourceDialer binds TCP and UDP connections to the local address source,
+// if it is valid. net.Dialer needs a LocalAddr of the dialed network's
+// type, so it is filled in per dial.
+type sourceDialer struct {
+	net.Dialer
+	source netip.Addr
+}
+
+func (d *sourceDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !d.source.IsValid() {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+	nd := d.Dialer
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		nd.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(d.source, 0))
+	case "udp", "udp4", "udp6":
+		nd.LocalAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(d.source, 0))
+	}
+	return nd.DialContext(ctx, network, address)
+}
+
+// checkDialSource reports whether DialSource can be bound, so that a
+// wrong address fails at startup rather than on every dial.
+func (f *Forwarder) checkDialSource() error {
+	if !f.DialSource.IsValid() || f.Dialer != nil {
+		return nil
+	}
+	l, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(netip.AddrPortFrom(f.DialSource, 0)))
+	if err != nil {
+		return fmt.Errorf("cannot bind dial source %s: %v", f.DialSource, err)
+	}
+	l.Close()
+	return nil
+}
+
+// dialAddr dials address through d, giving up after timeout if it is
+// positive. srv:// targets are first resolved to one of their instances,
+// and with DNSTTL set, TCP and UDP host names go through the forwarder's
+// cache; the lookups count towards timeout.
+func (f *Forwarder) dialAddr(ctx context.Context, logger *slog.Logger, d Dialer, network, address string, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if strings.HasPrefix(address, srvScheme) {
+		resolved, stale, err := f.srv.resolve(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		if stale != nil {
+			logger.Warn("Failed to refresh SRV records, using cached ones", "target", address, "error", stale)
+		}
+		address = resolved
+	}
+	if f.dns != nil && network != "unix" {
+		resolved, stale, err := f.dns.resolve(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if stale != nil {
+			logger.Warn("Failed to re-resolve target, using cached addresses", "target", address, "error", stale)
+		}
+		address = resolved
+	}
+	return d.DialContext(ctx, network, address)
+}
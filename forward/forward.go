@@ -0,0 +1,1795 @@
+// Package forward relays stream (TCP and Unix socket) and UDP traffic from
+// a source address to a target address.
+//
+// A Forwarder logs through its Logger field, a *slog.Logger, and falls
+// back to slog.Default(); the package does not use the global log
+// package.
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultDialTimeout     = 10 * time.Second
+	DefaultShutdownTimeout = 30 * time.Second
+	DefaultUDPTimeout      = 60 * time.Second
+	DefaultFailTimeout     = 10 * time.Second
+	DefaultHealthTimeout   = 2 * time.Second
+	DefaultKeepAlive       = 30 * time.Second
+	DefaultSocketBuffer    = 1024 * 1024
+	DefaultBufferSize      = 128 * 1024
+	DefaultDialRetryDelay  = 100 * time.Millisecond
+	DefaultFallbackDelay   = 300 * time.Millisecond
+	DefaultLinger          = -1
+
+	// maxDialRetryWait caps the total time a client is held waiting
+	// between dial retries, however many are configured.
+	maxDialRetryWait = 10 * time.Second
+
+	// handshakeTimeout bounds the TLS handshake with a client.
+	handshakeTimeout = 10 * time.Second
+
+	// minAcceptRetryDelay and maxAcceptRetryDelay bound the wait before
+	// accepting again after an accept error, as in net/http.
+	minAcceptRetryDelay = 5 * time.Millisecond
+	maxAcceptRetryDelay = time.Second
+
+	// rejectTimeout bounds sending RejectMessage to a client.
+	rejectTimeout = 5 * time.Second
+)
+
+// Forwarder accepts connections on SourceAddr and relays them to one of
+// Targets, chosen round-robin. Configure it with Options passed to
+// NewForwarder, or through its exported fields before calling Run.
+type Forwarder struct {
+	// Protocol is "tcp" for stream sockets (TCP or Unix) or "udp".
+	Protocol string
+
+	// SourceAddr is the address to listen on, or a comma-separated list
+	// of addresses that all forward to the same targets and share the
+	// limits, statistics and shutdown of one forwarder. An address may
+	// start with a tcp://, tcp4://, tcp6:// or unix:// scheme to set its
+	// network; others are of SourceNetwork. UDP supports a single address
+	// only, and takes tcp4:// and tcp6:// to mean UDP over IPv4 or IPv6.
+	SourceAddr string
+
+	// Targets are host:port addresses or Unix socket paths, optionally
+	// with a network scheme as in SourceAddr, which takes precedence over
+	// TargetNetwork. A target of the form srv://name stands for the
+	// instances listed in that DNS SRV record, re-queried every DNSTTL or
+	// DefaultSRVRefresh. A target may end in =weight, a positive integer,
+	// to get a proportional share of the connections; the default weight
+	// is 1.
+	Targets []string
+
+	// TargetResolver, when set, is called for each TCP connection once it
+	// has been accepted, after any PROXY header and TLS handshake, to pick
+	// its targets from the client address, e.g. for routing by client
+	// network. It returns targets in the same form as a comma-separated
+	// target list, or "" to use Targets, which may then be empty. A
+	// connection whose targets cannot be resolved is closed. SNIRoutes
+	// still apply on top. The resolver runs on the connection's
+	// goroutine, so it is called concurrently. It cannot be combined
+	// with Transparent or UDP.
+	TargetResolver func(client net.Addr) (string, error)
+
+	// SourceNetwork is "tcp", "tcp4", "tcp6" or "unix". NewForwarder
+	// takes it from the scheme of the first address in SourceAddr, or
+	// detects it from the address: an abstract socket name or an existing
+	// path is a Unix socket, anything else a TCP address. Set it to
+	// override the detection; schemes still win.
+	SourceNetwork string
+
+	// TargetNetwork forces the network ("tcp", "tcp4", "tcp6" or "unix")
+	// of every target without a scheme. When empty, the network of each
+	// such target is detected on its own, like SourceNetwork.
+	TargetNetwork string
+
+	// Family, when set, is FamilyIPv4 or FamilyIPv6 and restricts every
+	// plain "tcp" source and target, whether detected or forced, to that
+	// IP family, as if it were "tcp4" or "tcp6": listeners only accept,
+	// and dials only reach, addresses of the family, and an IPv6 listener
+	// does not accept IPv4-mapped clients. tcp4:// and tcp6:// schemes
+	// keep their own family. For UDP it selects udp4 or udp6.
+	Family string
+
+	// DialTimeout bounds each connection attempt to the target. Zero
+	// means no timeout.
+	DialTimeout time.Duration
+
+	// DialRetries is how many more rounds over the targets are tried when
+	// none of them could be dialed, waiting DialRetryDelay before the
+	// first retry and doubling the wait after each one. The waits add up
+	// to at most 10s. Zero disables retries.
+	DialRetries    int
+	DialRetryDelay time.Duration
+
+	// RejectMessage, when set, is sent to a TCP client as a line ending
+	// in CRLF once its connection has failed to reach any target, after
+	// all retries, just before it is closed. It lets a person on a text
+	// protocol see why; leave it empty for binary protocols, whose
+	// clients get a plain close.
+	RejectMessage string
+
+	// DialFallbackDelay is how long a dial to a host name with both IPv6
+	// and IPv4 addresses waits on the first family before racing a dial
+	// to the other (RFC 8305 Happy Eyeballs), as net.Dialer.FallbackDelay.
+	// Zero uses DefaultFallbackDelay; negative disables the race. It only
+	// applies with the default Dialer and without DNSTTL, which hands the
+	// Dialer one address at a time.
+	DialFallbackDelay time.Duration
+
+	// DialSource, when valid, is the local IP that TCP and UDP connections
+	// to targets are made from, e.g. to pick the interface on a
+	// multi-homed host. It only applies with the default Dialer.
+	DialSource netip.Addr
+
+	// SOCKS5, when set, is the host:port of a SOCKS5 proxy that target
+	// connections, health probes and the Mirror are dialed through, with
+	// SOCKS5User and SOCKS5Password if either is set. Host names are
+	// resolved by the proxy unless DNSTTL is set. DialTimeout and the
+	// retries cover the whole dial through the proxy. Only TCP targets
+	// can be reached this way.
+	SOCKS5         string
+	SOCKS5User     string
+	SOCKS5Password string
+
+	// HTTPProxy, when set, is the host:port of an HTTP proxy that target
+	// connections are tunnelled through with CONNECT, like SOCKS5, with
+	// Basic authentication if HTTPProxyUser or HTTPProxyPassword is set.
+	// The CONNECT exchange counts towards DialTimeout. It cannot be
+	// combined with SOCKS5.
+	HTTPProxy         string
+	HTTPProxyUser     string
+	HTTPProxyPassword string
+
+	// DNSTTL, when positive, resolves target host names once and caches
+	// the addresses for this long instead of looking them up on every
+	// dial. A name with several addresses is dialed round-robin across
+	// them. Zero leaves resolution to the Dialer.
+	DNSTTL time.Duration
+
+	// LBStrategy picks the target for each connection: RoundRobin (the
+	// default) takes turns, LeastConn prefers the targets with the fewest
+	// open connections, which evens out load when some connections last
+	// much longer than others, and Sticky sends each client IP to the
+	// same target for as long as that target is available. Clients
+	// without an IP, such as those of a Unix source, get RoundRobin.
+	LBStrategy string
+
+	// ShutdownTimeout bounds how long in-flight connections may keep
+	// running after Run's context is cancelled before they are
+	// force-closed.
+	ShutdownTimeout time.Duration
+
+	// UDPTimeout is how long a UDP session may stay quiet in both
+	// directions before it is reclaimed. It must be positive for UDP.
+	UDPTimeout time.Duration
+
+	// IdleTimeout closes a TCP connection once neither side has sent
+	// anything for this long. Every chunk of data read from or written to
+	// either side resets it, however small. Zero disables it.
+	IdleTimeout time.Duration
+
+	// ReadTimeout closes a TCP connection once a single read from either
+	// side has waited this long for data, and WriteTimeout once a single
+	// write to either side has waited this long for the peer to take it.
+	// Unlike IdleTimeout, which needs both directions to go quiet, they
+	// apply to each direction on its own: with ReadTimeout, a peer that
+	// stays silent while the other one talks is timed out too. Time spent
+	// waiting for rate limits does not count. Zero disables either.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxLifetime closes a TCP connection this long after it was
+	// accepted, however busy it is, so clients reconnect and get
+	// rebalanced. Zero disables it.
+	MaxLifetime time.Duration
+
+	// ReconnectTarget, when positive, is how many times a TCP connection
+	// whose target closes it cleanly, while the client is still
+	// connected, is reconnected to a target instead of being closed,
+	// e.g. for a backend that hangs up on idle clients and expects them to
+	// come back. The new connection is made like the first one, with a
+	// fresh PROXY header and TLS handshake, and the client's traffic
+	// simply carries on over it: nothing is buffered or replayed, so the
+	// new target knows nothing of what was said before. That is only
+	// safe for protocols whose requests stand on their own; for anything
+	// with a handshake, a login or state kept by the server, it hands the
+	// target a stream that starts mid-conversation. Data the client sends
+	// while the connection is being replaced may be lost. Targets that
+	// fail or reset the connection are not reconnected. It cannot be
+	// combined with Compress or UDP, and it stops the data from being
+	// spliced.
+	ReconnectTarget int
+
+	// MaxFails ejects a target from the rotation after this many
+	// consecutive failed dials; it is re-admitted after FailTimeout. Zero
+	// disables ejection.
+	MaxFails    int
+	FailTimeout time.Duration
+
+	// HealthInterval, when positive, starts a background probe per target
+	// that dials it this often; targets whose probe fails within
+	// HealthTimeout receive no new connections until a probe succeeds.
+	// Probes only run for TCP forwarding.
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+
+	// LatencyInterval, when positive, measures how long it takes to
+	// connect to each target, this often, to follow the targets'
+	// responsiveness over time; Latencies reports the latest probe and
+	// the minimum, average and maximum over the last LatencyWindow, or
+	// DefaultLatencyWindow if it is zero, and the same summary is logged
+	// once per window. Each probe is a dial bounded by HealthTimeout,
+	// made like a connection's, through any proxy, and closed at once.
+	// Unlike health probes, they never take a target out of rotation.
+	// Probes only run for TCP forwarding.
+	LatencyInterval time.Duration
+	LatencyWindow   time.Duration
+
+	// RateLimit caps each connection at this many bytes per second, and
+	// GlobalRateLimit caps all connections of the forwarder together.
+	// Both count traffic in both directions; zero means unlimited.
+	RateLimit       int64
+	GlobalRateLimit int64
+
+	// UploadRate caps each connection's client to target direction at
+	// this many bytes per second, and DownloadRate its target to client
+	// direction, for links whose capacity differs each way. They apply
+	// on top of RateLimit and GlobalRateLimit; zero means unlimited.
+	UploadRate   int64
+	DownloadRate int64
+
+	// MaxConns limits how many connections are handled at once; zero
+	// means no limit. At the limit, new connections are closed straight
+	// away, or, with MaxConnsWait, left waiting until a slot frees up.
+	// With QueueTimeout instead, a connection waits up to that long for a
+	// slot before it is closed, to ride out short bursts. Either way,
+	// later connections wait in the listen backlog meanwhile.
+	MaxConns     int
+	MaxConnsWait bool
+	QueueTimeout time.Duration
+
+	// AcceptRate, when positive, caps how many TCP connections are taken
+	// on per second, with bursts of up to one second's worth. Connections
+	// beyond it wait in the accept queue, so a herd of clients
+	// reconnecting at once reaches the targets gradually. It is separate
+	// from the bandwidth limits.
+	AcceptRate int
+
+	// MaxConnsPerIP limits how many connections a single client IP may
+	// have open at once; zero means no limit. It does not apply to Unix
+	// socket sources.
+	MaxConnsPerIP int
+
+	// Deny and Allow filter clients by IP. A client matching Deny is
+	// rejected; if Allow is non-empty, a client must also match it.
+	Deny  []*net.IPNet
+	Allow []*net.IPNet
+
+	// ProxyProtocol, when "v1" or "v2", sends a PROXY protocol header to
+	// the target ahead of the client's data, carrying the client address
+	// and the address the client connected to. With AcceptProxyProtocol,
+	// the client's header is replaced rather than passed on, so the
+	// target sees a single header with the original client address.
+	ProxyProtocol string
+
+	// AcceptProxyProtocol expects every client to start with a PROXY
+	// protocol v1 or v2 header, as sent by an upstream proxy. The header is
+	// stripped and its client address used for logging, the allow/deny
+	// lists and per-IP limits. Clients without a header are rejected
+	// unless ProxyProtocolOptional is set; malformed headers always are,
+	// as are two headers in a row, which point to a misconfigured or
+	// looping chain of proxies.
+	AcceptProxyProtocol   bool
+	ProxyProtocolOptional bool
+
+	// TLSConfig, when set, terminates TLS on accepted connections and
+	// forwards the decrypted stream to the target.
+	TLSConfig *tls.Config
+
+	// TargetTLSConfig, when set, wraps connections to the target in TLS.
+	// An empty ServerName defaults to the target's host.
+	TargetTLSConfig *tls.Config
+
+	// SNIRoutes sends TLS connections whose ClientHello names one of its
+	// keys to that key's targets instead of Targets. Server names are
+	// matched case-insensitively; connections without a listed name go to
+	// Targets. Unless TLSConfig is set, the ClientHello is only peeked at
+	// and reaches the target untouched. A matching name takes precedence
+	// over ProtocolRoutes.
+	SNIRoutes map[string][]string
+
+	// ProtocolRoutes sends connections whose first bytes identify one of
+	// its keys, SniffTLS, SniffSSH or SniffHTTP, to that protocol's
+	// targets instead of Targets, so that several services can share a
+	// port. The bytes are only peeked at and reach the target untouched.
+	// Connections of other protocols, and clients that send nothing for a
+	// few seconds, as with protocols where the server speaks first, go to
+	// Targets. With TLSConfig set, the protocol is that of the decrypted
+	// stream. A connection that also matches SNIRoutes goes to that
+	// route instead. It is ignored for UDP.
+	ProtocolRoutes map[string][]string
+
+	// KeepAlive is the TCP keep-alive period for client and target
+	// connections. Zero disables keep-alives.
+	KeepAlive time.Duration
+
+	// TCPUserTimeout, when positive, sets TCP_USER_TIMEOUT on client and
+	// target connections, so one whose sent data stays unacknowledged
+	// that long is dropped, well before keep-alives would notice a peer
+	// that vanished mid-transfer. It is Linux only and ignored, with a
+	// warning, elsewhere.
+	TCPUserTimeout time.Duration
+
+	// Linger sets SO_LINGER on client and target connections, in seconds.
+	// When negative, as NewForwarder sets it, closing a connection
+	// returns at once and the kernel still delivers unsent data in the
+	// background. Zero discards unsent data and resets the connection
+	// with an RST instead of closing it with a FIN, so the peer may miss
+	// the end of the stream; positive values make closing wait up to
+	// that long for unsent data to be acknowledged.
+	Linger int
+
+	// RecvBuffer and SendBuffer size the kernel socket buffers of TCP
+	// connections; zero leaves the OS default. BufferSize is the buffer
+	// each direction is copied through when the kernel cannot move the
+	// data itself; zero uses the io.Copy default.
+	RecvBuffer int
+	SendBuffer int
+	BufferSize int
+
+	// MaxBufferedBytes, when positive, caps the memory all TCP connections
+	// together may hold in copy buffers. Each connection needs two
+	// buffers' worth, one per direction, for as long as it is relayed,
+	// whether or not the kernel splices its data. A connection that does
+	// not fit waits, without reading from either side, until others
+	// finish, so its peers are slowed down by TCP flow control rather
+	// than growing the forwarder's memory. Zero means no limit.
+	MaxBufferedBytes int64
+
+	// Logger receives the forwarder's log output, tagged with SourceAddr.
+	// When nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	// Dialer connects to targets and health-checks them. When nil, a
+	// net.Dialer is used. DialTimeout applies either way.
+	Dialer Dialer
+
+	// Listener, when set, is used instead of listening on SourceAddr,
+	// which then only serves as a label in logs if it is set. Run closes
+	// the listener when it returns. It is ignored for UDP. Serve and
+	// ServePacket take a listener or packet connection directly.
+	Listener net.Listener
+
+	// PeerCred reads the credentials of the process behind each Unix
+	// socket client with SO_PEERCRED (Linux only; ignored, with a
+	// warning, elsewhere). They are added to the connection's log lines
+	// as "pid", "uid" and "gid", and the client address passed to
+	// OnAccept, OnConnect and OnClose is a *PeerAddr carrying them. They
+	// are not passed on to the target.
+	PeerCred bool
+
+	// OnAccept, OnConnect and OnClose, when set, are called as each client
+	// connection is accepted, connected to a target and closed. id is
+	// the connection's ID, which its log lines carry as "conn". The
+	// client is the address from the PROXY header when one is accepted.
+	// OnClose is called once for every connection passed to OnAccept,
+	// including those rejected or never connected, with bytesIn read from
+	// the client, bytesOut written to it, the time since accept and the
+	// error, if any, that ended it. The callbacks run on the connection's
+	// goroutine, so they are called concurrently and must not block for
+	// long. They are not called for UDP.
+	OnAccept  func(id uint64, client net.Addr)
+	OnConnect func(id uint64, client, target net.Addr)
+	OnClose   func(id uint64, client net.Addr, bytesIn, bytesOut int64, dur time.Duration, err error)
+
+	// UnixMode, when non-zero, is the permission mode of a Unix socket
+	// source, e.g. 0660. UnixOwner and UnixGroup, when set, are the user
+	// and group, by name or numeric ID, that own the socket file.
+	UnixMode  os.FileMode
+	UnixOwner string
+	UnixGroup string
+
+	// DSCP, when positive, marks the packets of TCP connections on both
+	// sides with this DSCP code point (0-63) for QoS. It is ignored, with
+	// a warning, where the platform cannot set it.
+	DSCP int
+
+	// Mirror, when set, is a second target that gets a copy of what each
+	// client sends, e.g. to try a new backend with real traffic. Its
+	// replies are discarded. The mirror never slows down the primary
+	// connection: a mirror that cannot connect, fails or falls behind is
+	// cut off for the rest of that connection. It is dialed like a
+	// target, but without PROXY headers or TLS.
+	Mirror string
+
+	// CaptureDir, when set, is a directory that gets a copy of each TCP
+	// connection's traffic, one file per direction, for offline analysis.
+	// CaptureFormat is CaptureRaw (the default) or CaptureFramed. Each
+	// file stops growing at CaptureMaxBytes: zero uses
+	// DefaultCaptureMaxBytes and negative means no limit. Capturing is
+	// best effort; a capture that fails does not affect the connection.
+	CaptureDir      string
+	CaptureFormat   string
+	CaptureMaxBytes int64
+
+	// Compress, when set, compresses TCP traffic to the target with this
+	// algorithm, CompressDeflate or CompressGzip, and decompresses its
+	// replies, to save bandwidth on a slow or metered link. The target
+	// must be a forwarder with Decompress set to the same algorithm,
+	// which relays plain traffic to the real target: both ends must
+	// agree, as nothing on the wire says how it is compressed. Decompress
+	// does the reverse on the client side. Compression happens inside
+	// target TLS, costs some CPU and a few hundred KiB of memory per
+	// connection, and gains nothing on data that is already compressed or
+	// encrypted, such as TLS passed through. Byte counts, captures and
+	// the Mirror see the uncompressed data; rate limits count the bytes
+	// as they are read from each socket.
+	Compress   string
+	Decompress string
+
+	// Transparent makes the forwarder a transparent proxy (Linux only,
+	// TCP only, needs CAP_NET_ADMIN). The listener accepts connections
+	// redirected to it with iptables TPROXY or REDIRECT, each one is
+	// forwarded to the address the client originally connected to instead
+	// of Targets, and the target connection is made from the client's IP
+	// so the target sees the real client. SNIRoutes still apply.
+	Transparent bool
+
+	// StrictOptimize drops connections whose socket options (TCP_NODELAY,
+	// keep-alive, buffer sizes, DSCP) cannot all be set. By default such
+	// a connection is forwarded as it is, with a warning.
+	StrictOptimize bool
+
+	// NoOptimize leaves client and target connections as Go sets them
+	// up: none of the socket options above (TCP_NODELAY, KeepAlive,
+	// buffer sizes, DSCP, TCPUserTimeout, Linger) are touched, which
+	// helps tell whether the tuning is behind a problem.
+	NoOptimize bool
+
+	// MPTCP enables Multipath TCP on the listener and on connections to
+	// targets, so either side may spread a connection over several
+	// paths. Where the kernel or the peer does not support it, plain TCP
+	// is used. For targets it only applies with the default Dialer.
+	MPTCP bool
+
+	// Backlog, when positive, is the length of the queue of TCP
+	// connections the kernel has completed but Run has not accepted yet,
+	// to absorb bursts instead of refusing them. Zero keeps Go's default,
+	// the system maximum. It does not apply to Unix socket sources or a
+	// Listener, and is ignored, with a warning, where the platform
+	// cannot set it.
+	Backlog int
+
+	// ReusePort sets SO_REUSEPORT on the listening socket, so that a new
+	// process can bind the same address while this one drains. It is
+	// ignored, with a warning, where the platform lacks SO_REUSEPORT.
+	ReusePort bool
+
+	// LiveBytes counts each TCP connection's bytes as they are copied, so
+	// that Conns reports them while the connection is open rather than
+	// as each direction finishes. The data then always passes through a
+	// buffer, so the kernel cannot splice it.
+	LiveBytes bool
+
+	// StatsInterval, when positive, logs the forwarder's throughput this
+	// often: the bytes per second copied each way and the connections
+	// accepted since the previous line, and the connections active. The
+	// bytes are counted as they are copied, so, as with LiveBytes, TCP
+	// data then always passes through a buffer.
+	StatsInterval time.Duration
+
+	mu       sync.Mutex
+	logger   *slog.Logger // Logger with the source attached, set by Run
+	ctx      context.Context
+	cancel   context.CancelFunc
+	listener io.Closer
+	addrs    []net.Addr       // bound addresses, for Addr
+	draining atomic.Bool      // set by Drain
+	self     []netip.AddrPort // listening addresses, for Transparent mode
+	balancer *balancer
+	routes   map[string]*balancer // SNIRoutes
+	sniffed  map[string]*balancer // ProtocolRoutes
+	limiter  *rateLimiter         // shared by all connections, nil if unlimited
+	accepts  *rateLimiter         // AcceptRate in connections, nil if unlimited
+	budget   *byteBudget          // MaxBufferedBytes, nil if unlimited
+	dns      *dnsCache            // nil unless DNSTTL is set
+	srv      *srvCache
+	slots    chan struct{} // counting semaphore for MaxConns, nil if unlimited
+	perIP    ipCounter
+	buffers  sync.Pool // *[]byte of BufferSize bytes
+	stats    counters
+	registry connRegistry
+	latency  latencyRegistry
+
+	// connCtx is the parent of every per-connection context. It outlives
+	// ctx so connections can drain, and is cancelled by killConns once
+	// ShutdownTimeout expires.
+	connCtx   context.Context
+	killConns context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewForwarder returns a Forwarder from source to target, which may be a
+// comma-separated list of targets to balance across. Fields not set by
+// opts keep their defaults.
+func NewForwarder(source, target string, opts ...Option) *Forwarder {
+	f := &Forwarder{
+		Protocol:      "tcp",
+		SourceAddr:    source,
+		Targets:       SplitTargets(target),
+		SourceNetwork: sourceNetwork(source),
+		DialTimeout:   DefaultDialTimeout,
+
+		DialRetryDelay:  DefaultDialRetryDelay,
+		ShutdownTimeout: DefaultShutdownTimeout,
+		UDPTimeout:      DefaultUDPTimeout,
+		FailTimeout:     DefaultFailTimeout,
+		HealthTimeout:   DefaultHealthTimeout,
+		KeepAlive:       DefaultKeepAlive,
+		RecvBuffer:      DefaultSocketBuffer,
+		SendBuffer:      DefaultSocketBuffer,
+		BufferSize:      DefaultBufferSize,
+		Linger:          DefaultLinger,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// sourceNetwork returns the network of the first address of a
+// comma-separated source list.
+func sourceNetwork(source string) string {
+	if sources := SplitTargets(source); len(sources) > 0 {
+		source = sources[0]
+	}
+	network, _ := splitNetwork(source, "")
+	return network
+}
+
+// splitNetwork returns the network of addr and the address without any
+// scheme. A tcp://, tcp4://, tcp6:// or unix:// scheme decides the
+// network; without one, network applies if it is set, and failing that
+// the network is detected from addr.
+func splitNetwork(addr, network string) (string, string) {
+	if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+		switch scheme {
+		case "tcp", "tcp4", "tcp6", "unix":
+			return scheme, rest
+		}
+	}
+	if network != "" {
+		return network, addr
+	}
+	return detectNetwork(addr), addr
+}
+
+// IP families for Forwarder.Family.
+const (
+	FamilyIPv4 = "4"
+	FamilyIPv6 = "6"
+)
+
+// ParseFamily validates an IP family for Forwarder.Family. "4" and "ipv4"
+// mean IPv4, "6" and "ipv6" IPv6, and "" and "any" no restriction.
+func ParseFamily(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", "any":
+		return "", nil
+	case "4", "ipv4":
+		return FamilyIPv4, nil
+	case "6", "ipv6":
+		return FamilyIPv6, nil
+	default:
+		return "", fmt.Errorf("invalid IP family %q (want 4, 6 or any)", s)
+	}
+}
+
+// withFamily restricts the TCP network network to f's Family.
+func (f *Forwarder) withFamily(network string) string {
+	if network == "tcp" {
+		return network + f.Family
+	}
+	return network
+}
+
+// isTCP reports whether network is one of the TCP networks, which also
+// stand for the matching UDP networks when forwarding UDP.
+func isTCP(network string) bool {
+	return network == "tcp" || network == "tcp4" || network == "tcp6"
+}
+
+// udpNetwork returns the UDP network matching the TCP network network.
+func udpNetwork(network string) string {
+	return "udp" + strings.TrimPrefix(network, "tcp")
+}
+
+// detectNetwork guesses the network for addr: an abstract socket name or
+// an existing path on disk is treated as a Unix socket, anything else as a
+// TCP address.
+func detectNetwork(addr string) string {
+	if isAbstract(addr) {
+		return "unix"
+	}
+	if _, err := os.Stat(addr); err == nil {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// ParseProtocol validates a protocol name for Forwarder.Protocol.
+func ParseProtocol(p string) (string, error) {
+	switch p {
+	case "tcp", "udp":
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown protocol %q (want tcp or udp)", p)
+	}
+}
+
+// ParseNetworkType validates a network name for Forwarder.SourceNetwork or
+// Forwarder.TargetNetwork.
+func ParseNetworkType(t string) (string, error) {
+	switch t {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return t, nil
+	default:
+		return "", fmt.Errorf("unknown network type %q (want tcp, tcp4, tcp6 or unix)", t)
+	}
+}
+
+// isAbstract reports whether addr names a Linux abstract Unix socket,
+// written with a leading @. Such sockets have no file on disk.
+func isAbstract(addr string) bool {
+	return strings.HasPrefix(addr, "@")
+}
+
+// removeStaleSocket deletes a leftover Unix socket file at path so a new
+// listener can bind to it. Anything that is not a socket is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to remove %s: not a socket", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+	}
+	return nil
+}
+
+// listenConfig returns the ListenConfig for the source listener.
+func (f *Forwarder) listenConfig() net.ListenConfig {
+	var controls []func(network, address string, c syscall.RawConn) error
+	if f.ReusePort {
+		if reusePortControl != nil {
+			controls = append(controls, reusePortControl)
+		} else {
+			f.logger.Warn("SO_REUSEPORT is not supported, ignoring ReusePort", "os", runtime.GOOS)
+		}
+	}
+	if f.Transparent {
+		controls = append(controls, transparentControl)
+	}
+
+	var lc net.ListenConfig
+	if f.MPTCP {
+		lc.SetMultipathTCP(true)
+	}
+	if len(controls) > 0 {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			for _, control := range controls {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return lc
+}
+
+// Start runs the forwarder until its listener fails. It is equivalent to
+// Run with a background context.
+func (f *Forwarder) Start() error {
+	return f.Run(context.Background())
+}
+
+// Run forwards traffic until ctx is cancelled or Stop is called. It then
+// stops accepting new connections, waits up to ShutdownTimeout for active
+// ones to finish, and returns nil. It refuses to start if a target is
+// the forwarder's own listening address, as connections would loop back
+// to it without end.
+func (f *Forwarder) Run(ctx context.Context) error {
+	return f.run(ctx, f.Listener, nil)
+}
+
+// Serve forwards the connections accepted on l, which it closes when it
+// returns, like Run with Listener set to l. It returns once Stop is
+// called and the connections have drained. The forwarder's Protocol
+// must be "tcp".
+func (f *Forwarder) Serve(l net.Listener) error {
+	if f.Protocol == "udp" {
+		return errors.New("Serve needs a TCP forwarder; use ServePacket for UDP")
+	}
+	return f.run(context.Background(), l, nil)
+}
+
+// ServePacket forwards the datagrams arriving on pc, which it closes when
+// it returns, instead of listening on SourceAddr. It returns once Stop is
+// called. The forwarder's Protocol must be "udp".
+func (f *Forwarder) ServePacket(pc net.PacketConn) error {
+	if f.Protocol != "udp" {
+		return errors.New("ServePacket needs a UDP forwarder; use Serve for TCP")
+	}
+	return f.run(context.Background(), nil, pc)
+}
+
+// run is Run, on the listener l or the packet connection pc if either is
+// set.
+func (f *Forwarder) run(ctx context.Context, l net.Listener, pc net.PacketConn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	connCtx, killConns := context.WithCancel(context.Background())
+	defer killConns()
+
+	logger := f.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	source := f.SourceAddr
+	switch {
+	case source != "":
+	case l != nil:
+		source = l.Addr().String()
+	case pc != nil:
+		source = pc.LocalAddr().String()
+	}
+
+	f.mu.Lock()
+	f.logger = logger.With("source", source)
+	f.ctx, f.cancel = ctx, cancel
+	f.connCtx, f.killConns = connCtx, killConns
+	f.mu.Unlock()
+
+	if err := f.checkDialSource(); err != nil {
+		return err
+	}
+	if err := f.checkCaptureDir(); err != nil {
+		return err
+	}
+
+	if f.NoOptimize {
+		f.logger.Debug("Connection optimization disabled, leaving socket options as Go sets them")
+	} else if f.DSCP > 0 && setDSCP == nil {
+		f.logger.Warn("DSCP marking is not supported, ignoring DSCP", "os", runtime.GOOS)
+	}
+	if !f.NoOptimize && f.TCPUserTimeout > 0 && setUserTimeout == nil {
+		f.logger.Warn("TCP user timeout is not supported, ignoring TCPUserTimeout", "os", runtime.GOOS)
+	}
+	if f.PeerCred && readPeerCred == nil {
+		f.logger.Warn("Peer credentials are not supported, ignoring PeerCred", "os", runtime.GOOS)
+	}
+	if f.Backlog > 0 && f.Protocol == "tcp" && isTCP(f.SourceNetwork) && l == nil {
+		if setBacklog == nil {
+			f.logger.Warn("Setting the listen backlog is not supported, ignoring Backlog", "os", runtime.GOOS)
+		} else if limit := maxBacklog(); limit > 0 && f.Backlog > limit {
+			f.logger.Warn("Listen backlog is capped by the kernel", "backlog", f.Backlog, "somaxconn", limit)
+		}
+	}
+
+	// Sessions would be reclaimed before the target could answer
+	if f.Protocol == "udp" && f.UDPTimeout <= 0 {
+		return fmt.Errorf("UDP timeout must be positive, got %s", f.UDPTimeout)
+	}
+
+	if f.SOCKS5 != "" && f.HTTPProxy != "" {
+		return errors.New("a SOCKS5 and an HTTP proxy cannot be used together")
+	}
+	if (f.SOCKS5 != "" || f.HTTPProxy != "") && (f.Protocol == "udp" || f.Transparent) {
+		return errors.New("a proxy can only be used for TCP forwarding to fixed targets")
+	}
+
+	if f.TargetResolver != nil && (f.Protocol == "udp" || f.Transparent) {
+		return errors.New("a target resolver can only be used for TCP forwarding without transparent mode")
+	}
+
+	if f.ReconnectTarget > 0 && (f.Protocol == "udp" || f.Compress != "") {
+		return errors.New("reconnecting to targets is only supported for TCP without compression")
+	}
+
+	if f.Family != "" && f.Family != FamilyIPv4 && f.Family != FamilyIPv6 {
+		return fmt.Errorf("invalid IP family %q (want FamilyIPv4 or FamilyIPv6)", f.Family)
+	}
+
+	for _, alg := range []string{f.Compress, f.Decompress} {
+		if alg == "" {
+			continue
+		}
+		if _, err := ParseCompression(alg); err != nil {
+			return err
+		}
+		if f.Protocol == "udp" {
+			return errors.New("compression is only supported for TCP")
+		}
+	}
+
+	if f.Transparent {
+		if transparentControl == nil {
+			return fmt.Errorf("transparent mode is not supported on %s", runtime.GOOS)
+		}
+		if f.Protocol == "udp" {
+			return errors.New("transparent mode is only supported for TCP")
+		}
+	}
+
+	// In transparent mode every connection brings its own target, and a
+	// resolver may provide all of them
+	var err error
+	f.balancer = nil
+	if !f.Transparent && (f.TargetResolver == nil || len(f.Targets) > 0) {
+		if f.balancer, err = f.newBalancer(f.Targets); err != nil {
+			return err
+		}
+	}
+	f.routes = nil
+	for name, targets := range f.SNIRoutes {
+		bal, err := f.newBalancer(targets)
+		if err != nil {
+			return fmt.Errorf("route %s: %v", name, err)
+		}
+		if f.routes == nil {
+			f.routes = make(map[string]*balancer)
+		}
+		f.routes[strings.ToLower(name)] = bal
+	}
+	f.sniffed = nil
+	for protocol, targets := range f.ProtocolRoutes {
+		if _, err := ParseSniffProtocol(protocol); err != nil {
+			return err
+		}
+		bal, err := f.newBalancer(targets)
+		if err != nil {
+			return fmt.Errorf("route %s: %v", protocol, err)
+		}
+		if f.sniffed == nil {
+			f.sniffed = make(map[string]*balancer)
+		}
+		f.sniffed[protocol] = bal
+	}
+
+	f.limiter = nil
+	if f.GlobalRateLimit > 0 {
+		f.limiter = newRateLimiter(f.GlobalRateLimit)
+	}
+
+	f.budget = nil
+	if f.MaxBufferedBytes > 0 {
+		if need := 2 * f.copyBufferSize(); f.MaxBufferedBytes < need {
+			return fmt.Errorf("max buffered bytes must be at least %d, the buffers of one connection", need)
+		}
+		f.budget = newByteBudget(f.MaxBufferedBytes)
+	}
+
+	f.accepts = nil
+	if f.AcceptRate > 0 {
+		f.accepts = newRateLimiter(int64(f.AcceptRate))
+	}
+
+	f.dns, f.srv = nil, newSRVCache(DefaultSRVRefresh)
+	if f.DNSTTL > 0 {
+		f.dns, f.srv = newDNSCache(f.DNSTTL), newSRVCache(f.DNSTTL)
+	}
+
+	f.slots = nil
+	if f.MaxConns > 0 {
+		f.slots = make(chan struct{}, f.MaxConns)
+	}
+
+	if f.StatsInterval > 0 {
+		go f.logThroughput(ctx)
+	}
+
+	if f.Protocol == "udp" {
+		return f.runUDP(ctx, pc)
+	}
+
+	listeners, err := f.listen(ctx, l)
+	if err != nil {
+		return err
+	}
+	for _, l := range listeners {
+		defer l.Close()
+	}
+	var addrs []net.Addr
+	for _, l := range listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	f.setListener(closers(listeners), addrs)
+	if f.draining.Load() {
+		// Drain was called before the listeners were set
+		closers(listeners).Close()
+	}
+
+	if err := f.checkLoops(ctx, addrs); err != nil {
+		return err
+	}
+
+	f.self = nil
+	for _, l := range listeners {
+		if f.Transparent {
+			if addr, ok := l.Addr().(*net.TCPAddr); ok {
+				f.self = append(f.self, addr.AddrPort())
+			}
+			f.logger.Info("Forwarding transparently", f.listenerAttrs(l, len(listeners))...)
+		} else if f.balancer == nil {
+			f.logger.Info("Forwarding to resolved targets", f.listenerAttrs(l, len(listeners))...)
+		} else {
+			f.logger.Info("Forwarding", append(f.listenerAttrs(l, len(listeners)), "target", f.balancer.String())...)
+		}
+	}
+	for name, bal := range f.routes {
+		f.logger.Info("Routing server name", "server_name", name, "target", bal.String())
+	}
+	for protocol, bal := range f.sniffed {
+		f.logger.Info("Routing protocol", "protocol", protocol, "target", bal.String())
+	}
+
+	dialer := f.dialer()
+	probeDial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return f.dialAddr(ctx, f.logger, dialer, network, address, f.HealthTimeout)
+	}
+	if f.HealthInterval > 0 {
+		for _, bal := range f.balancers() {
+			bal.probeBackends(ctx, probeDial, f.HealthInterval)
+		}
+	}
+	if f.LatencyInterval > 0 {
+		f.probeLatency(ctx, probeDial)
+	}
+
+	// Handle graceful shutdown: stop accepting, then drain
+	stop := context.AfterFunc(ctx, func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	})
+	defer stop()
+
+	var accepting sync.WaitGroup
+	for _, l := range listeners {
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			f.acceptLoop(ctx, l)
+		}()
+	}
+	accepting.Wait()
+
+	if ctx.Err() == nil && f.draining.Load() {
+		// Connections carry on until the forwarder is stopped
+		<-ctx.Done()
+	}
+	f.logger.Info("Shutting down listener")
+	f.drain()
+	return nil
+}
+
+// listen returns l if it is set, or else a listener for each address in
+// SourceAddr. Either all listeners are returned or none.
+func (f *Forwarder) listen(ctx context.Context, l net.Listener) ([]net.Listener, error) {
+	if l != nil {
+		return []net.Listener{l}, nil
+	}
+	sources := SplitTargets(f.SourceAddr)
+	if len(sources) == 0 {
+		return nil, errors.New("no source address")
+	}
+	var listeners []net.Listener
+	for _, source := range sources {
+		l, err := f.listenOn(ctx, source)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenOn listens on one source address, preparing Unix socket files.
+func (f *Forwarder) listenOn(ctx context.Context, source string) (net.Listener, error) {
+	network, source := splitNetwork(source, f.SourceNetwork)
+	network = f.withFamily(network)
+	if network == "unix" && !isAbstract(source) {
+		if err := removeStaleSocket(source); err != nil {
+			return nil, err
+		}
+	}
+
+	lc := f.listenConfig()
+	listener, err := lc.Listen(ctx, network, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start listener: %v", err)
+	}
+	if network == "unix" && !isAbstract(source) {
+		if err := f.setSocketPerms(source); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if tl, ok := listener.(*net.TCPListener); ok && f.Backlog > 0 && setBacklog != nil {
+		if err := setBacklog(tl, f.Backlog); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// listenerAttrs returns the log attributes describing l. The listening
+// address is only added when there are several, or when it says more than
+// the source the logger already carries, e.g. the port picked for port 0.
+func (f *Forwarder) listenerAttrs(l net.Listener, n int) []any {
+	attrs := []any{"network", l.Addr().Network()}
+	if n > 1 || (f.SourceAddr != "" && l.Addr().String() != f.SourceAddr) {
+		attrs = append(attrs, "listen", l.Addr().String())
+	}
+	return attrs
+}
+
+// closers closes all of its listeners.
+type closers []net.Listener
+
+func (c closers) Close() error {
+	var errs []error
+	for _, l := range c {
+		errs = append(errs, l.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// acceptLoop accepts connections on listener and starts a goroutine for
+// each, until the listener is closed, normally on shutdown. Other accept
+// errors, such as running out of file descriptors, are retried after a
+// delay that doubles while they persist, so they do not spin the CPU.
+func (f *Forwarder) acceptLoop(ctx context.Context, listener net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				if f.draining.Load() {
+					return
+				}
+				f.logger.Error("Listener closed, no longer accepting", "listen", listener.Addr().String())
+				return
+			}
+			delay = min(max(2*delay, minAcceptRetryDelay), maxAcceptRetryDelay)
+			f.logger.Error("Error accepting connection", "error", err, "retry_in", delay)
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return
+			}
+			continue
+		}
+		delay = 0
+		// Later connections wait in the listen backlog meanwhile
+		if f.accepts != nil {
+			if err := f.accepts.wait(ctx, 1); err != nil {
+				conn.Close()
+				return
+			}
+		}
+		ci := f.newConnInfo()
+		f.stats.accepted.Add(1)
+		ci.logger.Debug("Accepted connection", "client", conn.RemoteAddr().String())
+
+		if !f.acquireSlot(ctx, conn, ci.logger) {
+			f.stats.failed.Add(1)
+			conn.Close()
+			continue
+		}
+
+		if err := f.optimizeConn(conn); err != nil {
+			if f.StrictOptimize {
+				ci.logger.Error("Failed to optimize connection", "client", conn.RemoteAddr().String(), "error", err)
+				f.stats.failed.Add(1)
+				conn.Close()
+				f.releaseSlot()
+				continue
+			}
+			ci.logger.Warn("Failed to optimize connection, forwarding it anyway", "client", conn.RemoteAddr().String(), "error", err)
+		}
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer f.releaseSlot()
+			if !f.serveConn(conn, ci) {
+				f.stats.failed.Add(1)
+			}
+		}()
+	}
+}
+
+// serveConn reads the client's PROXY header, if one is expected, and passes
+// the connection on to admitConn, reporting it to the OnAccept and OnClose
+// callbacks. It reports whether the connection made it through to a
+// target.
+func (f *Forwarder) serveConn(conn net.Conn, ci connInfo) bool {
+	if f.AcceptProxyProtocol {
+		pc, err := readProxyHeader(conn)
+		switch {
+		case errors.Is(err, errNoProxyHeader) && f.ProxyProtocolOptional:
+		case err != nil:
+			ci.logger.Warn("Rejecting connection", "client", conn.RemoteAddr().String(), "error", err)
+			conn.Close()
+			return false
+		}
+		conn = pc
+	}
+	if f.PeerCred {
+		conn, ci.logger = withPeerCred(conn, ci.logger)
+	}
+
+	client := conn.RemoteAddr()
+	if f.OnAccept != nil {
+		f.OnAccept(ci.id, client)
+	}
+	res := f.admitConn(conn, ci)
+	if f.OnClose != nil {
+		f.OnClose(ci.id, client, res.sent, res.received, time.Since(ci.accepted), res.err)
+	}
+	return res.connected
+}
+
+// connIDs numbers client connections and UDP sessions across all
+// forwarders in the process, so an ID is enough to find a connection's
+// log lines.
+var connIDs atomic.Uint64
+
+// connInfo identifies a client connection while it is being handled.
+type connInfo struct {
+	id       uint64
+	accepted time.Time
+	logger   *slog.Logger // the forwarder's logger with the ID attached
+}
+
+func (f *Forwarder) newConnInfo() connInfo {
+	id := connIDs.Add(1)
+	return connInfo{id: id, accepted: time.Now(), logger: f.logger.With("conn", id)}
+}
+
+// connResult is the outcome of a client connection.
+type connResult struct {
+	connected      bool // a target connection was established
+	sent, received int64
+	err            error
+}
+
+var (
+	errNotAllowed    = errors.New("client address not allowed")
+	errTooManyFromIP = errors.New("too many connections from client IP")
+	errLifetime      = errors.New("connection lifetime expired")
+	errReadTimeout   = errors.New("read timed out")
+	errWriteTimeout  = errors.New("write timed out")
+	errClosed        = errors.New("connection closed on request")
+)
+
+// admitConn applies the per-client checks, terminates TLS if configured,
+// picks the targets and hands the connection to handleConnection.
+func (f *Forwarder) admitConn(conn net.Conn, ci connInfo) connResult {
+	if !f.allowed(conn, ci.logger) {
+		conn.Close()
+		return connResult{err: errNotAllowed}
+	}
+	ip, ok := f.acquireIP(conn, ci.logger)
+	if !ok {
+		conn.Close()
+		return connResult{err: errTooManyFromIP}
+	}
+	defer f.releaseIP(ip)
+
+	// TLS is layered on here rather than with tls.NewListener so that a
+	// PROXY header, which precedes the handshake, has already been read
+	if f.TLSConfig != nil {
+		tlsConn := tls.Server(conn, f.TLSConfig)
+		ctx, cancel := context.WithTimeout(f.connCtx, handshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			err = tlsError(err)
+			ci.logger.Warn("TLS handshake failed", "client", conn.RemoteAddr().String(), "error", err)
+			conn.Close()
+			return connResult{err: fmt.Errorf("TLS handshake: %v", err)}
+		}
+		conn = tlsConn
+	}
+
+	bal := f.balancer
+	if f.Transparent {
+		var err error
+		if bal, err = f.originalDstBalancer(conn); err != nil {
+			if errors.Is(err, errSelfDestination) {
+				ci.logger.Warn("Rejecting connection", "client", conn.RemoteAddr().String(), "error", err)
+			} else {
+				ci.logger.Error("Failed to get original destination", "client", conn.RemoteAddr().String(), "error", err)
+			}
+			conn.Close()
+			return connResult{err: err}
+		}
+	}
+	if f.TargetResolver != nil {
+		var err error
+		if bal, err = f.resolveTargets(conn.RemoteAddr(), bal); err != nil {
+			ci.logger.Warn("Rejecting connection", "client", conn.RemoteAddr().String(), "error", err)
+			conn.Close()
+			return connResult{err: err}
+		}
+	}
+	// A TLS connection terminated here already knows its server name;
+	// take it before sniffing wraps the connection. SNIRoutes win over
+	// ProtocolRoutes when both match
+	var name string
+	tlsConn, terminated := conn.(*tls.Conn)
+	if terminated {
+		name = tlsConn.ConnectionState().ServerName
+	}
+	peek := f.routes != nil && !terminated
+	if f.sniffed != nil {
+		var protocol string
+		conn, protocol = sniffProtocol(conn)
+		if route, ok := f.sniffed[protocol]; ok {
+			bal = route
+		}
+		// Anything else has no ClientHello to wait for
+		peek = peek && protocol == SniffTLS
+	}
+	if peek {
+		conn, name = peekServerName(conn)
+	}
+	if route, ok := f.routes[strings.ToLower(name)]; ok {
+		bal = route
+	}
+
+	return f.handleConnection(conn, bal, ci)
+}
+
+// balancers returns the balancer over Targets, if there is one, followed
+// by those of SNIRoutes by server name and of ProtocolRoutes by protocol.
+func (f *Forwarder) balancers() []*balancer {
+	var bals []*balancer
+	if f.balancer != nil {
+		bals = append(bals, f.balancer)
+	}
+	for _, name := range slices.Sorted(maps.Keys(f.routes)) {
+		bals = append(bals, f.routes[name])
+	}
+	for _, protocol := range slices.Sorted(maps.Keys(f.sniffed)) {
+		bals = append(bals, f.sniffed[protocol])
+	}
+	return bals
+}
+
+// resolveTargets asks TargetResolver for the targets of a connection from
+// client, returning a balancer over them, or def if it leaves the choice
+// to Targets.
+func (f *Forwarder) resolveTargets(client net.Addr, def *balancer) (*balancer, error) {
+	targets, err := f.TargetResolver(client)
+	if err != nil {
+		return nil, fmt.Errorf("resolving target: %w", err)
+	}
+	if targets == "" {
+		if def == nil {
+			return nil, errors.New("resolving target: no target for client")
+		}
+		return def, nil
+	}
+	bal, err := f.newBalancer(SplitTargets(targets))
+	if err != nil {
+		return nil, fmt.Errorf("resolving target: %w", err)
+	}
+	return bal, nil
+}
+
+// Stop makes a running Run return: the listener is closed before Stop
+// returns, so its address can be reused immediately, and active
+// connections are drained as for context cancellation. It is a no-op if
+// the forwarder is not running.
+func (f *Forwarder) Stop() {
+	f.mu.Lock()
+	cancel, listener := f.cancel, f.listener
+	f.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	if listener != nil {
+		listener.Close()
+	}
+}
+
+// Drain closes the listener, so that no more connections are accepted,
+// while active connections carry on; Run keeps running until the context
+// is done or Stop is called, then drains what is left as usual. UDP
+// sessions end with the listener, as their replies are sent through it.
+// Drain may be called more than once, and before Run.
+func (f *Forwarder) Drain() {
+	f.draining.Store(true)
+	f.mu.Lock()
+	listener := f.listener
+	f.mu.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+}
+
+// Draining reports whether Drain has been called.
+func (f *Forwarder) Draining() bool {
+	return f.draining.Load()
+}
+
+func (f *Forwarder) setListener(l io.Closer, addrs []net.Addr) {
+	f.mu.Lock()
+	f.listener, f.addrs = l, addrs
+	f.mu.Unlock()
+}
+
+// Addr returns the address the forwarder listens on, which tells the port
+// the system picked when SourceAddr has port 0. With several source
+// addresses, it is the first one's; Addrs returns them all. It is nil
+// until Run has bound the listener; to know the address beforehand, bind
+// the listener yourself and pass it as Listener or to Serve.
+func (f *Forwarder) Addr() net.Addr {
+	addrs := f.Addrs()
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0]
+}
+
+// Addrs returns the addresses the forwarder listens on, as for Addr.
+func (f *Forwarder) Addrs() []net.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.addrs)
+}
+
+// drain waits for active connections to finish, force-closing whatever is
+// still open once ShutdownTimeout has elapsed.
+func (f *Forwarder) drain() {
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(f.ShutdownTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+
+	f.logger.Warn("Shutdown timeout exceeded, closing remaining connections")
+	f.killConns()
+	<-done
+}
+
+// prepareTarget readies a fresh connection to the target b for relaying
+// the client's traffic: it sends the PROXY header, completes the TLS
+// handshake and sets socket options, per the forwarder's settings. It
+// returns the connection to relay through, which is conn unless TLS wraps
+// it.
+func (f *Forwarder) prepareTarget(ctx context.Context, logger *slog.Logger, clientConn, conn net.Conn, b *backend) (net.Conn, error) {
+	// The header carries the TCP addresses of the client side whatever
+	// the target network, so Unix socket targets learn the client's IP;
+	// nothing of the client's has been relayed yet
+	if f.ProxyProtocol != "" {
+		if err := writeProxyHeader(conn, f.ProxyProtocol, clientConn.RemoteAddr(), clientConn.LocalAddr()); err != nil {
+			logger.Warn("Failed to send PROXY header to target", "target", b.addr, "error", err)
+			return nil, fmt.Errorf("sending PROXY header: %v", err)
+		}
+	}
+
+	// The PROXY header travels in the clear, ahead of the TLS handshake
+	if f.TargetTLSConfig != nil {
+		tlsConn, err := f.targetHandshake(ctx, conn, b)
+		if err != nil {
+			err = tlsError(err)
+			logger.Warn("TLS handshake with target failed", "target", b.addr, "error", err)
+			return nil, fmt.Errorf("TLS handshake with target: %v", err)
+		}
+		conn = tlsConn
+	}
+
+	if err := f.optimizeConn(conn); err != nil {
+		if f.StrictOptimize {
+			logger.Error("Failed to optimize target connection", "target", b.addr, "error", err)
+			return nil, err
+		}
+		logger.Warn("Failed to optimize target connection, forwarding it anyway", "target", b.addr, "error", err)
+	}
+	return conn, nil
+}
+
+// dialTarget connects through dialer to the backend of bal that comes
+// first for a client from IP key, falling back to the following ones in
+// turn if a dial fails. If all of them fail, it retries per DialRetries
+// with exponential backoff.
+func (f *Forwarder) dialTarget(ctx context.Context, logger *slog.Logger, dialer Dialer, bal *balancer, key string) (net.Conn, *backend, error) {
+	delay, waited := f.DialRetryDelay, time.Duration(0)
+	for attempt := 0; ; attempt++ {
+		conn, b, err := f.dialBackends(ctx, logger, dialer, bal, key)
+		if err == nil || ctx.Err() != nil || attempt >= f.DialRetries || delay <= 0 {
+			return conn, b, err
+		}
+		if waited+delay > maxDialRetryWait {
+			logger.Warn("Giving up on target dial retries", "waited", waited)
+			return nil, nil, err
+		}
+		logger.Warn("Retrying target dial", "attempt", attempt+1, "retries", f.DialRetries, "delay", delay)
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, nil, err
+		}
+		waited += delay
+		delay *= 2
+	}
+}
+
+// dialBackends tries each available target in bal once, in the order
+// for a client from IP key, and returns the first connection that
+// succeeds.
+func (f *Forwarder) dialBackends(ctx context.Context, logger *slog.Logger, dialer Dialer, bal *balancer, key string) (net.Conn, *backend, error) {
+	var err error
+	for _, b := range bal.order(key) {
+		var conn net.Conn
+		conn, err = f.dialAddr(ctx, logger, dialer, b.network, b.addr, f.DialTimeout)
+		if err == nil {
+			bal.markSuccess(b)
+			return conn, b, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if isTimeout(err) {
+			logger.Warn("Timed out connecting to target", "target", b.addr, "timeout", f.DialTimeout)
+		} else {
+			logger.Warn("Failed to connect to target", "target", b.addr, "error", err)
+		}
+		bal.markFailure(b)
+	}
+	return nil, nil, err
+}
+
+// connLimiters returns the rate limiters each direction of a new
+// connection must pass through: its own, if RateLimit is set, and the
+// forwarder-wide one, which both directions share, followed by that
+// direction's own if UploadRate or DownloadRate is set.
+func (f *Forwarder) connLimiters() (up, down []*rateLimiter) {
+	var shared []*rateLimiter
+	if f.RateLimit > 0 {
+		shared = append(shared, newRateLimiter(f.RateLimit))
+	}
+	if f.limiter != nil {
+		shared = append(shared, f.limiter)
+	}
+	up, down = shared, shared
+	if f.UploadRate > 0 {
+		up = append(slices.Clip(shared), newRateLimiter(f.UploadRate))
+	}
+	if f.DownloadRate > 0 {
+		down = append(slices.Clip(shared), newRateLimiter(f.DownloadRate))
+	}
+	return up, down
+}
+
+// handleConnection connects clientConn to a target from bal and relays
+// traffic until both directions are done, then logs what was transferred
+// since the connection was accepted.
+func (f *Forwarder) handleConnection(clientConn net.Conn, bal *balancer, ci connInfo) connResult {
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(f.connCtx)
+	defer cancel()
+
+	dialer := f.dialer()
+	if f.Transparent {
+		dialer = f.transparentDialer(clientConn.RemoteAddr())
+	}
+	targetConn, b, err := f.dialTarget(ctx, ci.logger, dialer, bal, clientIP(clientConn.RemoteAddr()))
+	if err != nil {
+		if f.RejectMessage != "" && ctx.Err() == nil {
+			clientConn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+			if _, werr := io.WriteString(clientConn, f.RejectMessage+"\r\n"); werr != nil {
+				ci.logger.Debug("Failed to send reject message", "client", clientConn.RemoteAddr().String(), "error", werr)
+			}
+		}
+		return connResult{err: err}
+	}
+	defer targetConn.Close()
+	b.active.Add(1)
+	defer func() { b.active.Add(-1) }()
+
+	if targetConn, err = f.prepareTarget(ctx, ci.logger, clientConn, targetConn, b); err != nil {
+		return connResult{err: err}
+	}
+	if f.ReconnectTarget > 0 {
+		rc := &reconnectingConn{conn: targetConn, max: f.ReconnectTarget}
+		rc.redial = func(n int) (net.Conn, error) {
+			conn, nb, err := f.dialTarget(ctx, ci.logger, dialer, bal, clientIP(clientConn.RemoteAddr()))
+			if err != nil {
+				if ctx.Err() == nil {
+					ci.logger.Warn("Failed to reconnect to target, closing", "client", clientConn.RemoteAddr().String(), "error", err)
+				}
+				return nil, err
+			}
+			if conn, err = f.prepareTarget(ctx, ci.logger, clientConn, conn, nb); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			nb.active.Add(1)
+			b.active.Add(-1)
+			b = nb
+			ci.logger.Info("Reconnected to target", "client", clientConn.RemoteAddr().String(), "target", b.addr,
+				"reconnect", n, "max", f.ReconnectTarget)
+			return conn, nil
+		}
+		defer rc.Close()
+		targetConn = rc
+	}
+
+	// Unblock both copy directions if the connection is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		now := time.Now()
+		clientConn.SetDeadline(now)
+		targetConn.SetDeadline(now)
+	})
+	defer stop()
+
+	// Cancelling ctx trips the deadlines above; expired tells that apart
+	// from a shutdown or an idle timeout once the copies return
+	var expired atomic.Bool
+	if f.MaxLifetime > 0 {
+		t := time.AfterFunc(time.Until(ci.accepted.Add(f.MaxLifetime)), func() {
+			expired.Store(true)
+			cancel()
+		})
+		defer t.Stop()
+	}
+
+	if f.OnConnect != nil {
+		f.OnConnect(ci.id, clientConn.RemoteAddr(), targetConn.RemoteAddr())
+	}
+	if f.MPTCP {
+		ci.logger.Debug("Multipath TCP", "client", usesMPTCP(clientConn), "target", usesMPTCP(targetConn))
+	}
+
+	if f.budget != nil {
+		n := 2 * f.copyBufferSize()
+		if err := f.budget.acquire(ctx, n); err != nil {
+			return connResult{connected: true, err: err}
+		}
+		defer f.budget.release(n)
+	}
+
+	f.stats.active.Add(1)
+	defer f.stats.active.Add(-1)
+	live := &liveConn{client: clientConn.RemoteAddr().String(), target: b.addr, accepted: ci.accepted, cancel: cancel}
+	f.registry.add(ci.id, live)
+	defer f.registry.remove(ci.id)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// The timeouts go innermost, so they only time the socket calls. Data
+	// counts as activity for IdleTimeout as soon as it is read, before
+	// any rate limit holds it back
+	var timedOut atomic.Pointer[opTimeout]
+	var clientReader, targetReader io.Reader = clientConn, targetConn
+	var clientWriter, targetWriter io.Writer = clientConn, targetConn
+	if f.IdleTimeout > 0 {
+		idle := newIdleTracker(f.IdleTimeout)
+		deadline := time.Now().Add(f.IdleTimeout)
+		clientConn.SetReadDeadline(deadline)
+		targetConn.SetReadDeadline(deadline)
+		clientReader = &idleReader{ctx: ctx, conn: clientConn, idle: idle}
+		targetReader = &idleReader{ctx: ctx, conn: targetConn, idle: idle}
+		clientWriter = &idleWriter{w: clientWriter, idle: idle}
+		targetWriter = &idleWriter{w: targetWriter, idle: idle}
+	}
+	if f.ReadTimeout > 0 {
+		ct := opTimer(&opTimeout{errReadTimeout, "client"}, &timedOut, cancel)
+		tt := opTimer(&opTimeout{errReadTimeout, "target"}, &timedOut, cancel)
+		defer ct.Stop()
+		defer tt.Stop()
+		clientReader = &timeoutReader{r: clientReader, timer: ct, timeout: f.ReadTimeout}
+		targetReader = &timeoutReader{r: targetReader, timer: tt, timeout: f.ReadTimeout}
+	}
+	if f.WriteTimeout > 0 {
+		ct := opTimer(&opTimeout{errWriteTimeout, "client"}, &timedOut, cancel)
+		tt := opTimer(&opTimeout{errWriteTimeout, "target"}, &timedOut, cancel)
+		defer ct.Stop()
+		defer tt.Stop()
+		clientWriter = &timeoutWriter{w: clientWriter, timer: ct, timeout: f.WriteTimeout}
+		targetWriter = &timeoutWriter{w: targetWriter, timer: tt, timeout: f.WriteTimeout}
+	}
+	up, down := f.connLimiters()
+	if len(up) > 0 {
+		clientReader = &limitedReader{ctx: ctx, r: clientReader, limiters: up}
+	}
+	if len(down) > 0 {
+		targetReader = &limitedReader{ctx: ctx, r: targetReader, limiters: down}
+	}
+	// Everything above sees the compressed stream, everything below the
+	// plain one
+	var targetZ, clientZ *compressWriter
+	if f.Compress != "" {
+		targetZ = newCompressWriter(f.Compress, targetWriter)
+		targetWriter = targetZ
+		targetReader = &decompressReader{alg: f.Compress, r: targetReader}
+	}
+	if f.Decompress != "" {
+		clientZ = newCompressWriter(f.Decompress, clientWriter)
+		clientWriter = clientZ
+		clientReader = &decompressReader{alg: f.Decompress, r: clientReader}
+	}
+	var m *mirror
+	if f.Mirror != "" {
+		m = f.startMirror(ci.logger)
+		defer m.close()
+		clientReader = &mirrorReader{r: clientReader, m: m}
+	}
+	if f.LiveBytes {
+		clientReader = &countingReader{r: clientReader, n: &live.in}
+		targetReader = &countingReader{r: targetReader, n: &live.out}
+	}
+	if f.StatsInterval > 0 {
+		clientReader = &countingReader{r: clientReader, n: &f.stats.copiedIn}
+		targetReader = &countingReader{r: targetReader, n: &f.stats.copiedOut}
+	}
+	if f.CaptureDir != "" {
+		sentFile, receivedFile, err := f.openCapture(ci, clientConn.RemoteAddr())
+		if err != nil {
+			ci.logger.Warn("Failed to create capture files, not capturing", "error", err)
+		} else {
+			defer sentFile.Close()
+			defer receivedFile.Close()
+			targetWriter = io.MultiWriter(targetWriter, sentFile)
+			clientWriter = io.MultiWriter(clientWriter, receivedFile)
+		}
+	}
+
+	var (
+		upErr, downErr error
+		sent, received int64
+	)
+
+	// A direction that ends in an error, e.g. a write to a peer that has
+	// reset the connection, cancels the other one too, which could
+	// otherwise sit in a read that never completes. A direction that ends
+	// cleanly only half-closes, as the peer may still have data to send.
+	var failed atomic.Pointer[copyFailure]
+	abort := func(direction string, err error) {
+		if err != nil && ctx.Err() == nil && failed.CompareAndSwap(nil, &copyFailure{direction, err}) {
+			cancel()
+		}
+	}
+
+	// Copy straight between the connections: when neither side is
+	// wrapped, io.CopyBuffer finds (*net.TCPConn).ReadFrom and can
+	// splice(2) the data in the kernel instead of going through a buffer
+	go func() {
+		defer wg.Done()
+		sent, upErr = f.copy(targetWriter, clientReader)
+		abort("upstream", upErr)
+		f.stats.bytesSent.Add(uint64(sent))
+		live.in.Store(sent)
+		// End the compressed stream so the peer sees a clean EOF
+		if targetZ != nil {
+			if err := targetZ.Close(); err != nil && upErr == nil {
+				upErr = err
+			}
+		}
+		closeWrite(targetConn)
+		if m != nil {
+			m.close()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		received, downErr = f.copy(clientWriter, targetReader)
+		abort("downstream", downErr)
+		f.stats.bytesReceived.Add(uint64(received))
+		live.out.Store(received)
+		if clientZ != nil {
+			if err := clientZ.Close(); err != nil && downErr == nil {
+				downErr = err
+			}
+		}
+		closeWrite(clientConn)
+	}()
+
+	wg.Wait()
+
+	// Errors caused by cancellation or an idle timeout are reported
+	// below; anything else broke the stream mid-way, e.g. a reset. The
+	// other direction then only failed because it was cut short
+	if c := failed.Load(); c != nil {
+		if !(f.IdleTimeout > 0 && isTimeout(c.err)) {
+			ci.logger.Warn("Copy failed", "client", clientConn.RemoteAddr().String(), "target", b.addr,
+				"direction", c.direction, "error", c.err)
+		}
+		upErr, downErr = c.err, nil
+	}
+
+	if live.closed.Load() {
+		ci.logger.Info("Connection closed on request", "client", clientConn.RemoteAddr().String())
+		upErr, downErr = errClosed, nil
+	} else if expired.Load() {
+		ci.logger.Info("Connection lifetime expired, closing", "client", clientConn.RemoteAddr().String(), "lifetime", f.MaxLifetime)
+		upErr, downErr = errLifetime, nil
+	} else if t := timedOut.Load(); t != nil {
+		timeout := f.ReadTimeout
+		if t.err == errWriteTimeout {
+			timeout = f.WriteTimeout
+		}
+		ci.logger.Warn("Connection timed out, closing", "client", clientConn.RemoteAddr().String(), "peer", t.peer,
+			"error", t.err, "timeout", timeout)
+		upErr, downErr = fmt.Errorf("%s: %w", t.peer, t.err), nil
+	} else if f.IdleTimeout > 0 && (isTimeout(upErr) || isTimeout(downErr)) {
+		ci.logger.Info("Connection idle, closing", "client", clientConn.RemoteAddr().String(), "timeout", f.IdleTimeout)
+	}
+	// io.Copy reports what it wrote even when it fails, so the counts
+	// hold for directions that ended in an error too
+	ci.logger.Info("Connection closed", "client", clientConn.RemoteAddr().String(), "target", b.addr,
+		"sent", sent, "received", received, "duration", time.Since(ci.accepted).Round(time.Millisecond))
+
+	err = upErr
+	if err == nil {
+		err = downErr
+	}
+	return connResult{connected: true, sent: sent, received: received, err: err}
+}
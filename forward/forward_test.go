@@ -0,0 +1,254 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestForwarder returns a quiet Forwarder to target with a short
+// ShutdownTimeout.
+func newTestForwarder(target string, opts ...Option) *Forwarder {
+	opts = append([]Option{
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithShutdownTimeout(time.Second),
+	}, opts...)
+	return NewForwarder("", target, opts...)
+}
+
+// serve runs f.Serve on l until the test ends.
+func serve(tb testing.TB, f *Forwarder, l net.Listener) {
+	tb.Helper()
+	done := make(chan error, 1)
+	go func() { done <- f.Serve(l) }()
+	for f.Addr() == nil {
+		select {
+		case err := <-done:
+			tb.Fatalf("Serve: %v", err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	tb.Cleanup(func() {
+		f.Stop()
+		if err := <-done; err != nil {
+			tb.Errorf("Serve: %v", err)
+		}
+	})
+}
+
+// listenEcho starts a loopback TCP server that echoes back what it reads,
+// until the test ends.
+func listenEcho(tb testing.TB) net.Listener {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// echo writes msg to conn and checks that it comes back unchanged. It
+// writes while it reads, so msg may be larger than the buffers on the
+// way.
+func echo(tb testing.TB, conn net.Conn, msg []byte) {
+	tb.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(msg)
+		written <- err
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		tb.Fatalf("read: %v", err)
+	}
+	if err := <-written; err != nil {
+		tb.Fatalf("write: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		tb.Fatalf("echoed %d bytes differ from the %d sent", len(got), len(msg))
+	}
+}
+
+// recordingDialer dials with a net.Dialer and keeps the connections it
+// makes, so tests can inspect the forwarder's side of them.
+type recordingDialer struct {
+	net.Dialer
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err == nil {
+		d.mu.Lock()
+		d.conns = append(d.conns, conn)
+		d.mu.Unlock()
+	}
+	return conn, err
+}
+
+// last returns the connection dialed most recently.
+func (d *recordingDialer) last(tb testing.TB) net.Conn {
+	tb.Helper()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.conns) == 0 {
+		tb.Fatal("nothing dialed")
+	}
+	return d.conns[len(d.conns)-1]
+}
+
+// serveTCP runs f on a loopback listener until the test ends and returns
+// a connection to it.
+func serveTCP(tb testing.TB, f *Forwarder) net.Conn {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serve(tb, f, l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// pipeListener is an in-memory net.Listener whose connections are made
+// by dial.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// echoDialer is an in-memory Dialer whose connections echo back what
+// they are sent. It records the addresses dialed.
+type echoDialer struct {
+	mu    sync.Mutex
+	dials []string
+}
+
+func (d *echoDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials = append(d.dials, network+" "+address)
+	d.mu.Unlock()
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		io.Copy(server, server)
+	}()
+	return client, nil
+}
+
+func TestServeInMemory(t *testing.T) {
+	d := &echoDialer{}
+	f := newTestForwarder("backend:80")
+	f.Dialer = d
+	l := newPipeListener()
+	serve(t, f, l)
+
+	for i := range 3 {
+		conn, err := l.dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, conn, fmt.Appendf(nil, "hello %d", i))
+		conn.Close()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.dials) != 3 {
+		t.Fatalf("dialed %d times, want 3", len(d.dials))
+	}
+	for _, got := range d.dials {
+		if got != "tcp backend:80" {
+			t.Errorf("dialed %q, want %q", got, "tcp backend:80")
+		}
+	}
+}
+
+// BenchmarkForwardTCP measures the throughput of a forward between
+// loopback TCP connections, echoing 1 MiB through it per operation. The
+// connections are copied into each other directly, which Linux does with
+// splice(2); counting the bytes as they pass forces a buffered copy
+// instead, for comparison.
+func BenchmarkForwardTCP(b *testing.B) {
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024/16)
+	for _, bc := range []struct {
+		name string
+		live bool
+	}{
+		{"direct", false},
+		{"buffered", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			f := newTestForwarder(listenEcho(b).Addr().String())
+			f.LiveBytes = bc.live
+			conn := serveTCP(b, f)
+			b.SetBytes(int64(len(msg)))
+			b.ResetTimer()
+			for range b.N {
+				echo(b, conn, msg)
+			}
+		})
+	}
+}
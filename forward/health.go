@@ -0,0 +1,50 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// probeFunc dials a backend for a health probe, within the probe timeout.
+type probeFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// probeBackends starts one health probe per backend. The probes stop when
+// ctx is done.
+func (b *balancer) probeBackends(ctx context.Context, dial probeFunc, interval time.Duration) {
+	for _, be := range b.backends {
+		go b.probe(ctx, dial, be, interval)
+	}
+}
+
+// probe dials be every interval until ctx is done, keeping it out of the
+// rotation while the dials fail.
+func (b *balancer) probe(ctx context.Context, dial probeFunc, be *backend, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		conn, err := dial(ctx, be.network, be.addr)
+		if err == nil {
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		healthy := err == nil
+		if wasUnhealthy := be.unhealthy.Swap(!healthy); wasUnhealthy == healthy {
+			if healthy {
+				b.logger.Info("Health check: target is healthy", "target", be.addr)
+			} else {
+				b.logger.Warn("Health check: target is unhealthy", "target", be.addr, "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
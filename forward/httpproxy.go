@@ -0,0 +1,92 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxConnectResponse caps the size of the header of a proxy's answer to
+// CONNECT.
+const maxConnectResponse = 64 * 1024
+
+// httpProxyDialer connects to TCP addresses through an HTTP proxy using
+// CONNECT, reaching the proxy with dialer. Host names are passed to the
+// proxy to resolve.
+type httpProxyDialer struct {
+	proxy          string
+	user, password string
+	dialer         Dialer
+}
+
+func (d *httpProxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("HTTP proxy %s: cannot dial %s address %s", d.proxy, network, address)
+	}
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP proxy: %w", err)
+	}
+
+	// The CONNECT exchange is bounded by ctx like the dial to the proxy
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	err = d.connect(conn, address)
+	if !stop() || err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("HTTP proxy %s: %w", d.proxy, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect asks the proxy for a tunnel to address and waits for it to
+// agree.
+func (d *httpProxyDialer) connect(conn net.Conn, address string) error {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if d.user != "" || d.password != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(d.user + ":" + d.password))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		return err
+	}
+
+	// The header is read a byte at a time: the target may speak first,
+	// and whatever follows the header has to be left on the connection
+	// rather than in a buffer, so that the connection can be spliced
+	var header []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		if len(header) >= maxConnectResponse {
+			return errors.New("response header too large")
+		}
+		n, err := conn.Read(b)
+		if err != nil {
+			return err
+		}
+		header = append(header, b[:n]...)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(header)), nil)
+	if err != nil {
+		return fmt.Errorf("malformed response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("connecting to %s: %s", address, resp.Status)
+	}
+	return nil
+}
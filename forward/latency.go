@@ -0,0 +1,171 @@
+package forward
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyWindow is the period LatencyInterval probes are
+// summarized over when LatencyWindow is zero.
+const DefaultLatencyWindow = 5 * time.Minute
+
+// TargetLatency summarizes the connect latency of a target, as measured
+// by the LatencyInterval probes of the last LatencyWindow.
+type TargetLatency struct {
+	Target string
+
+	Last   time.Duration // latest successful probe, zero until one succeeds
+	LastAt time.Time     // when that probe was made
+
+	// Min, Avg and Max are over the successful probes in the window,
+	// Probes of them; Failures counts the probes that failed.
+	Min, Avg, Max time.Duration
+	Probes        int
+	Failures      int
+}
+
+type latencySample struct {
+	at     time.Time
+	d      time.Duration
+	failed bool
+}
+
+// latencyTracker keeps the latency probes of one target for a window.
+type latencyTracker struct {
+	target string
+	window time.Duration
+
+	mu      sync.Mutex
+	samples []latencySample // oldest first
+	last    latencySample   // latest successful probe
+}
+
+func (t *latencyTracker) add(s latencySample) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = append(t.prune(s.at), s)
+	if !s.failed {
+		t.last = s
+	}
+}
+
+// prune drops the samples that have left the window as of now. t.mu must
+// be held.
+func (t *latencyTracker) prune(now time.Time) []latencySample {
+	i := 0
+	for i < len(t.samples) && now.Sub(t.samples[i].at) > t.window {
+		i++
+	}
+	return append(t.samples[:0], t.samples[i:]...)
+}
+
+func (t *latencyTracker) summary(now time.Time) TargetLatency {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = t.prune(now)
+	l := TargetLatency{Target: t.target, Last: t.last.d, LastAt: t.last.at}
+	var sum time.Duration
+	for _, s := range t.samples {
+		if s.failed {
+			l.Failures++
+			continue
+		}
+		if l.Probes == 0 || s.d < l.Min {
+			l.Min = s.d
+		}
+		l.Max = max(l.Max, s.d)
+		sum += s.d
+		l.Probes++
+	}
+	if l.Probes > 0 {
+		l.Avg = sum / time.Duration(l.Probes)
+	}
+	return l
+}
+
+// latencyRegistry holds the trackers of a running forwarder, for
+// Latencies.
+type latencyRegistry struct {
+	mu       sync.Mutex
+	trackers []*latencyTracker
+}
+
+// Latencies returns the connect latency of each target measured with
+// LatencyInterval, ordered as the targets are configured, followed by
+// those of SNI routes by server name and of protocol routes by protocol.
+// It is empty when latency probing is off.
+func (f *Forwarder) Latencies() []TargetLatency {
+	f.latency.mu.Lock()
+	trackers := f.latency.trackers
+	f.latency.mu.Unlock()
+	now := time.Now()
+	out := make([]TargetLatency, len(trackers))
+	for i, t := range trackers {
+		out[i] = t.summary(now)
+	}
+	return out
+}
+
+// probeLatency starts measuring how long dial takes to connect to each
+// target, every LatencyInterval, until ctx is done. A summary of each
+// target is logged once per window.
+func (f *Forwarder) probeLatency(ctx context.Context, dial probeFunc) {
+	window := f.LatencyWindow
+	if window <= 0 {
+		window = DefaultLatencyWindow
+	}
+	var trackers []*latencyTracker
+	seen := make(map[string]bool)
+	for _, bal := range f.balancers() {
+		for _, be := range bal.backends {
+			if seen[be.addr] {
+				continue
+			}
+			seen[be.addr] = true
+			t := &latencyTracker{target: be.addr, window: window}
+			trackers = append(trackers, t)
+			go f.probeTarget(ctx, dial, be, t)
+		}
+	}
+	f.latency.mu.Lock()
+	f.latency.trackers = trackers
+	f.latency.mu.Unlock()
+}
+
+// probeTarget dials be every LatencyInterval until ctx is done, recording
+// how long each dial took in t.
+func (f *Forwarder) probeTarget(ctx context.Context, dial probeFunc, be *backend, t *latencyTracker) {
+	ticker := time.NewTicker(f.LatencyInterval)
+	defer ticker.Stop()
+	report := time.Now().Add(t.window)
+
+	for {
+		start := time.Now()
+		conn, err := dial(ctx, be.network, be.addr)
+		d := time.Since(start)
+		if err == nil {
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			f.logger.Debug("Latency probe failed", "target", be.addr, "error", err)
+		}
+		t.add(latencySample{at: start, d: d, failed: err != nil})
+
+		if now := time.Now(); !now.Before(report) {
+			l := t.summary(now)
+			f.logger.Info("Target latency", "target", be.addr, "window", t.window,
+				"min", l.Min, "avg", l.Avg, "max", l.Max, "probes", l.Probes, "failures", l.Failures)
+			report = now.Add(t.window)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
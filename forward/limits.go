@@ -0,0 +1,179 @@
+package forward
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// acquireSlot reserves one of the MaxConns slots for conn. It reports
+// false if conn should be rejected instead.
+func (f *Forwarder) acquireSlot(ctx context.Context, conn net.Conn, logger *slog.Logger) bool {
+	if f.slots == nil {
+		return true
+	}
+	if f.MaxConnsWait {
+		select {
+		case f.slots <- struct{}{}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	if f.QueueTimeout > 0 {
+		t := time.NewTimer(f.QueueTimeout)
+		defer t.Stop()
+		select {
+		case f.slots <- struct{}{}:
+			return true
+		case <-t.C:
+			logger.Warn("Rejecting connection: too many connections", "client", conn.RemoteAddr().String(),
+				"max_conns", f.MaxConns, "waited", f.QueueTimeout)
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+	select {
+	case f.slots <- struct{}{}:
+		return true
+	default:
+		logger.Warn("Rejecting connection: too many connections", "client", conn.RemoteAddr().String(), "max_conns", f.MaxConns)
+		return false
+	}
+}
+
+func (f *Forwarder) releaseSlot() {
+	if f.slots != nil {
+		<-f.slots
+	}
+}
+
+// ipCounter counts active connections per client IP.
+type ipCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// clientIP returns the IP of a TCP or UDP peer address, or "" for
+// addresses that have no IP such as Unix sockets.
+func clientIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	return ""
+}
+
+// acquireIP counts conn against its client IP's MaxConnsPerIP budget. It
+// returns the IP to pass to releaseIP, and false if conn should be
+// rejected instead.
+func (f *Forwarder) acquireIP(conn net.Conn, logger *slog.Logger) (string, bool) {
+	if f.MaxConnsPerIP <= 0 {
+		return "", true
+	}
+	ip := clientIP(conn.RemoteAddr())
+	if ip == "" {
+		return "", true
+	}
+
+	f.perIP.mu.Lock()
+	defer f.perIP.mu.Unlock()
+	if f.perIP.counts == nil {
+		f.perIP.counts = make(map[string]int)
+	}
+	if f.perIP.counts[ip] >= f.MaxConnsPerIP {
+		logger.Warn("Rejecting connection: too many connections from this IP", "client", conn.RemoteAddr().String(), "max_conns_per_ip", f.MaxConnsPerIP)
+		return "", false
+	}
+	f.perIP.counts[ip]++
+	return ip, true
+}
+
+func (f *Forwarder) releaseIP(ip string) {
+	if ip == "" {
+		return
+	}
+	f.perIP.mu.Lock()
+	defer f.perIP.mu.Unlock()
+	if f.perIP.counts[ip]--; f.perIP.counts[ip] <= 0 {
+		delete(f.perIP.counts, ip)
+	}
+}
+
+// byteBudget is a weighted semaphore over a number of bytes. Waiters are
+// served in order, so a large request is not starved by small ones.
+type byteBudget struct {
+	mu      sync.Mutex
+	avail   int64
+	waiters list.List // of *budgetWaiter
+}
+
+type budgetWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+func newByteBudget(n int64) *byteBudget {
+	return &byteBudget{avail: n}
+}
+
+// acquire takes n bytes from the budget, waiting until they are available
+// or ctx is done.
+func (b *byteBudget) acquire(ctx context.Context, n int64) error {
+	b.mu.Lock()
+	if b.waiters.Len() == 0 && n <= b.avail {
+		b.avail -= n
+		b.mu.Unlock()
+		return nil
+	}
+	w := &budgetWaiter{n: n, ready: make(chan struct{})}
+	elem := b.waiters.PushBack(w)
+	b.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		select {
+		case <-w.ready:
+			// Granted just now; hand the bytes back
+			b.avail += n
+			b.wake()
+		default:
+			b.waiters.Remove(elem)
+			// Waiters queued behind this one may fit now
+			b.wake()
+		}
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// release returns n bytes to the budget.
+func (b *byteBudget) release(n int64) {
+	b.mu.Lock()
+	b.avail += n
+	b.wake()
+	b.mu.Unlock()
+}
+
+// wake grants waiting requests in order for as long as they fit. b.mu
+// must be held.
+func (b *byteBudget) wake() {
+	for elem := b.waiters.Front(); elem != nil; elem = b.waiters.Front() {
+		w := elem.Value.(*budgetWaiter)
+		if w.n > b.avail {
+			return
+		}
+		b.avail -= w.n
+		b.waiters.Remove(elem)
+		close(w.ready)
+	}
+}
@@ -0,0 +1,139 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// loopResolveTimeout bounds the lookup of each target host name while
+// checking for loops at startup.
+const loopResolveTimeout = 2 * time.Second
+
+// checkLoops returns an error if any target, including those of SNI and
+// protocol routes, is one of the addresses the forwarder listens on,
+// which would forward every connection back to the forwarder until it
+// runs out of file descriptors. Host names are resolved for the check;
+// one that cannot be resolved is let through, as the target may simply
+// not be up yet. Targets behind a proxy or discovered through SRV records
+// are not checked.
+func (f *Forwarder) checkLoops(ctx context.Context, listening []net.Addr) error {
+	if f.SOCKS5 != "" || f.HTTPProxy != "" {
+		return nil
+	}
+	var local []netip.Addr // the host's own IPs, looked up when needed
+	for _, bal := range f.balancers() {
+		for _, b := range bal.backends {
+			if strings.HasPrefix(b.addr, srvScheme) {
+				continue
+			}
+			for _, self := range listening {
+				if f.targetIs(ctx, b, self, &local) {
+					return fmt.Errorf("target %s is the forwarder's own address %s, which would loop", b.addr, self)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// targetIs reports whether dialing b would reach the listening address
+// self. local caches the host's IPs between calls.
+func (f *Forwarder) targetIs(ctx context.Context, b *backend, self net.Addr, local *[]netip.Addr) bool {
+	if b.network == "unix" {
+		if _, ok := self.(*net.UnixAddr); !ok {
+			return false
+		}
+		return samePath(b.addr, self.String())
+	}
+
+	var selfAddr netip.AddrPort
+	switch a := self.(type) {
+	case *net.TCPAddr:
+		selfAddr = a.AddrPort()
+	case *net.UDPAddr:
+		selfAddr = a.AddrPort()
+	default:
+		return false
+	}
+	host, portName, err := net.SplitHostPort(b.addr)
+	if err != nil {
+		return false
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, self.Network(), portName)
+	if err != nil || port != int(selfAddr.Port()) {
+		return false
+	}
+
+	var ips []netip.Addr
+	if host == "" {
+		ips = []netip.Addr{netip.IPv4Unspecified()}
+	} else if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else {
+		lookupCtx, cancel := context.WithTimeout(ctx, loopResolveTimeout)
+		ips, err = net.DefaultResolver.LookupNetIP(lookupCtx, "ip", host)
+		cancel()
+		if err != nil {
+			f.logger.Debug("Could not resolve target to check for loops", "target", b.addr, "error", err)
+			return false
+		}
+	}
+
+	selfIP := selfAddr.Addr().Unmap()
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		switch {
+		case ip == selfIP:
+			return true
+		case ip.IsUnspecified():
+			// Dialing an unspecified address reaches the loopback
+			if selfIP.IsLoopback() || selfIP.IsUnspecified() {
+				return true
+			}
+		case selfIP.IsUnspecified():
+			if *local == nil {
+				*local = localIPs()
+			}
+			if ip.IsLoopback() || slices.Contains(*local, ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// samePath reports whether two Unix socket addresses name the same
+// socket. Abstract addresses are compared as they are.
+func samePath(a, b string) bool {
+	if isAbstract(a) || isAbstract(b) {
+		return a == b
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
+
+// localIPs returns the IPs of the host's interfaces, or none if they
+// cannot be listed.
+func localIPs() []netip.Addr {
+	ips := []netip.Addr{}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, a := range addrs {
+		if prefix, err := netip.ParsePrefix(a.String()); err == nil {
+			ips = append(ips, prefix.Addr().Unmap())
+		}
+	}
+	return ips
+}
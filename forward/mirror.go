@@ -0,0 +1,146 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// mirrorQueueBytes is how much of the client's data may wait for a
+	// slow mirror before it is cut off.
+	mirrorQueueBytes = 4 << 20
+
+	// mirrorQueueChunks caps the number of reads waiting, however small.
+	mirrorQueueChunks = 1024
+
+	// mirrorWriteTimeout bounds each write to the mirror, so a stuck
+	// mirror cannot pin its goroutine.
+	mirrorWriteTimeout = 10 * time.Second
+)
+
+// mirror sends a copy of a client's stream to the Mirror target. It never
+// holds up the primary connection: data is queued, and a mirror that
+// falls behind or fails is cut off for the rest of the connection.
+type mirror struct {
+	logger *slog.Logger
+	addr   string
+	queue  chan []byte
+
+	mu     sync.Mutex
+	queued int  // bytes in queue
+	closed bool // queue is closed, nothing more is sent
+}
+
+// startMirror dials the Mirror target in the background and returns the
+// mirror to feed the client's data to. The mirror outlives the primary
+// connection until it has sent what was queued, unless the forwarder
+// force-closes its connections; like the connections, it is waited for
+// on shutdown.
+func (f *Forwarder) startMirror(logger *slog.Logger) *mirror {
+	m := &mirror{
+		logger: logger,
+		addr:   f.Mirror,
+		queue:  make(chan []byte, mirrorQueueChunks),
+	}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		m.run(f)
+	}()
+	return m
+}
+
+func (m *mirror) run(f *Forwarder) {
+	// Drain the queue however this ends, so nothing is left holding it
+	defer func() {
+		for range m.queue {
+		}
+	}()
+
+	ctx := f.connCtx
+	network, addr := splitNetwork(m.addr, "")
+	conn, err := f.dialAddr(ctx, m.logger, f.dialer(), f.withFamily(network), addr, f.DialTimeout)
+	if err != nil {
+		m.fail("Failed to connect to mirror", err)
+		return
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// Whatever the mirror answers is of no interest, but it has to be
+	// read so the mirror never stalls on a full send buffer
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		io.Copy(io.Discard, conn)
+	}()
+
+	for data := range m.queue {
+		m.mu.Lock()
+		m.queued -= len(data)
+		m.mu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(mirrorWriteTimeout))
+		if _, err := conn.Write(data); err != nil {
+			m.fail("Failed to write to mirror", err)
+			return
+		}
+	}
+	closeWrite(conn)
+}
+
+// fail logs err and stops queueing data for the mirror.
+func (m *mirror) fail(msg string, err error) {
+	m.logger.Warn(msg, "mirror", m.addr, "error", err)
+	m.close()
+}
+
+// send queues a copy of data for the mirror, cutting the mirror off if
+// more than mirrorQueueBytes would be waiting. The mirror then sees the
+// stream end early.
+func (m *mirror) send(data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	if m.queued+len(data) <= mirrorQueueBytes {
+		select {
+		case m.queue <- append([]byte(nil), data...):
+			m.queued += len(data)
+			return
+		default:
+		}
+	}
+	m.logger.Warn("Mirror fell behind, cutting it off", "mirror", m.addr)
+	m.closed = true
+	close(m.queue)
+}
+
+// close ends the mirrored stream, once the client is done sending or
+// the mirror failed.
+func (m *mirror) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+}
+
+// mirrorReader copies everything read from r to m.
+type mirrorReader struct {
+	r io.Reader
+	m *mirror
+}
+
+func (r *mirrorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.m.send(p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,89 @@
+package forward
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Option configures a Forwarder in NewForwarder. Each option sets the
+// exported field of the same name, which can also be set directly.
+type Option func(*Forwarder)
+
+// WithDialTimeout sets DialTimeout.
+func WithDialTimeout(d time.Duration) Option {
+	return func(f *Forwarder) { f.DialTimeout = d }
+}
+
+// WithShutdownTimeout sets ShutdownTimeout.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(f *Forwarder) { f.ShutdownTimeout = d }
+}
+
+// WithIdleTimeout sets IdleTimeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(f *Forwarder) { f.IdleTimeout = d }
+}
+
+// WithMaxLifetime sets MaxLifetime.
+func WithMaxLifetime(d time.Duration) Option {
+	return func(f *Forwarder) { f.MaxLifetime = d }
+}
+
+// WithTargetResolver sets TargetResolver.
+func WithTargetResolver(resolve func(client net.Addr) (string, error)) Option {
+	return func(f *Forwarder) { f.TargetResolver = resolve }
+}
+
+// WithSOCKS5 sets SOCKS5, SOCKS5User and SOCKS5Password, dialing targets
+// through a SOCKS5 proxy. user and password may be empty.
+func WithSOCKS5(proxy, user, password string) Option {
+	return func(f *Forwarder) {
+		f.SOCKS5, f.SOCKS5User, f.SOCKS5Password = proxy, user, password
+	}
+}
+
+// WithHTTPProxy sets HTTPProxy, HTTPProxyUser and HTTPProxyPassword,
+// dialing targets through an HTTP CONNECT proxy. user and password may be
+// empty.
+func WithHTTPProxy(proxy, user, password string) Option {
+	return func(f *Forwarder) {
+		f.HTTPProxy, f.HTTPProxyUser, f.HTTPProxyPassword = proxy, user, password
+	}
+}
+
+// WithLogger sets Logger.
+func WithLogger(l *slog.Logger) Option {
+	return func(f *Forwarder) { f.Logger = l }
+}
+
+// WithBufferSize sets BufferSize.
+func WithBufferSize(n int) Option {
+	return func(f *Forwarder) { f.BufferSize = n }
+}
+
+// WithTLSConfig sets TLSConfig, terminating TLS on the source.
+func WithTLSConfig(c *tls.Config) Option {
+	return func(f *Forwarder) { f.TLSConfig = c }
+}
+
+// WithTargetTLSConfig sets TargetTLSConfig, connecting to targets over TLS.
+func WithTargetTLSConfig(c *tls.Config) Option {
+	return func(f *Forwarder) { f.TargetTLSConfig = c }
+}
+
+// WithMaxConns sets MaxConns.
+func WithMaxConns(n int) Option {
+	return func(f *Forwarder) { f.MaxConns = n }
+}
+
+// WithAcceptRate sets AcceptRate, in connections per second.
+func WithAcceptRate(connsPerSec int) Option {
+	return func(f *Forwarder) { f.AcceptRate = connsPerSec }
+}
+
+// WithRateLimit sets RateLimit, in bytes per second per connection.
+func WithRateLimit(bytesPerSec int64) Option {
+	return func(f *Forwarder) { f.RateLimit = bytesPerSec }
+}
@@ -0,0 +1,42 @@
+package forward
+
+import (
+	"log/slog"
+	"net"
+)
+
+// PeerAddr is the address of a Unix socket client along with the
+// credentials of the process that connected, as read with PeerCred. It
+// is the client address passed to OnAccept, OnConnect and OnClose for
+// such clients.
+type PeerAddr struct {
+	net.Addr
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// withPeerCred returns conn reporting a *PeerAddr as its remote address,
+// and logger with the credentials attached, if conn is a Unix socket
+// connection whose peer credentials can be read. Otherwise both are
+// returned as they are.
+func withPeerCred(conn net.Conn, logger *slog.Logger) (net.Conn, *slog.Logger) {
+	if readPeerCred == nil {
+		return conn, logger
+	}
+	if _, ok := conn.RemoteAddr().(*net.UnixAddr); !ok {
+		return conn, logger
+	}
+	uc, ok := netConn(conn).(*net.UnixConn)
+	if !ok {
+		return conn, logger
+	}
+	addr, err := readPeerCred(uc)
+	if err != nil {
+		logger.Warn("Failed to read peer credentials", "error", err)
+		return conn, logger
+	}
+	addr.Addr = conn.RemoteAddr()
+	logger = logger.With("pid", addr.PID, "uid", addr.UID, "gid", addr.GID)
+	return &prefixConn{Conn: conn, remote: addr}, logger
+}
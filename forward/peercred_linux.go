@@ -0,0 +1,31 @@
+//go:build linux
+
+package forward
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// readPeerCred returns the credentials of the process at the other end of
+// conn, from SO_PEERCRED, in a PeerAddr without an address. It is a
+// variable so that other platforms can leave it nil.
+var readPeerCred = func(conn *net.UnixConn) (*PeerAddr, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get raw connection: %v", err)
+	}
+	var cred *syscall.Ucred
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to access socket: %v", err)
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("failed to get SO_PEERCRED: %v", sockErr)
+	}
+	return &PeerAddr{PID: cred.Pid, UID: cred.Uid, GID: cred.Gid}, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package forward
+
+import "net"
+
+// readPeerCred is nil where SO_PEERCRED is not available.
+var readPeerCred func(conn *net.UnixConn) (*PeerAddr, error)
@@ -0,0 +1,249 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+const proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+// ParseProxyProtocol validates a PROXY protocol version for
+// Forwarder.ProxyProtocol. The empty string disables it.
+func ParseProxyProtocol(v string) (string, error) {
+	switch v {
+	case "", "v1", "v2":
+		return v, nil
+	default:
+		return "", fmt.Errorf("unknown PROXY protocol version %q (want v1 or v2)", v)
+	}
+}
+
+// writeProxyHeader writes a PROXY protocol header to w describing a
+// connection from src to dst, the address the client connected to.
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	var header []byte
+	switch version {
+	case "v1":
+		header = proxyHeaderV1(src, dst)
+	case "v2":
+		header = proxyHeaderV2(src, dst)
+	default:
+		return fmt.Errorf("unknown PROXY protocol version %q", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// proxyAddrs returns src and dst as TCP addresses of the same family,
+// with IPv4 addresses in their 4-byte form. ok is false if either is not
+// a TCP address.
+func proxyAddrs(src, dst net.Addr) (s, d *net.TCPAddr, v4, ok bool) {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, nil, false, false
+	}
+	if s4, d4 := s.IP.To4(), d.IP.To4(); s4 != nil && d4 != nil {
+		return &net.TCPAddr{IP: s4, Port: s.Port}, &net.TCPAddr{IP: d4, Port: d.Port}, true, true
+	}
+	return &net.TCPAddr{IP: s.IP.To16(), Port: s.Port}, &net.TCPAddr{IP: d.IP.To16(), Port: d.Port}, false, true
+}
+
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	s, d, v4, ok := proxyAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP6"
+	if v4 {
+		family = "TCP4"
+	}
+	return []byte("PROXY " + family + " " + s.IP.String() + " " + d.IP.String() + " " +
+		strconv.Itoa(s.Port) + " " + strconv.Itoa(d.Port) + "\r\n")
+}
+
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	header := []byte(proxyV2Signature)
+	header = append(header, 0x21) // version 2, PROXY command
+
+	s, d, v4, ok := proxyAddrs(src, dst)
+	if !ok {
+		// UNSPEC: the receiver ignores the (empty) address block
+		return append(header, 0x00, 0x00, 0x00)
+	}
+
+	if v4 {
+		header = append(header, 0x11) // TCP over IPv4
+	} else {
+		header = append(header, 0x21) // TCP over IPv6
+	}
+	var addrs []byte
+	addrs = append(addrs, s.IP...)
+	addrs = append(addrs, d.IP...)
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// maxProxyV1Length is the longest a v1 header line may be, CRLF included.
+const maxProxyV1Length = 107
+
+// proxyHeaderTimeout bounds how long a client has to send its PROXY header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// errNoProxyHeader is returned by readProxyHeader when the connection does
+// not start with a PROXY protocol header.
+var errNoProxyHeader = errors.New("no PROXY protocol header")
+
+// errDoubledProxyHeader is returned by readProxyHeader when a second
+// header follows the first, as when a proxy that does not accept the
+// protocol adds its own header in front of its client's, or a chain of
+// proxies loops. The client address in either header cannot be trusted.
+var errDoubledProxyHeader = errors.New("second PROXY protocol header after the first, check the proxies in front")
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from conn. The
+// returned conn replays any bytes read past the header, so no client data
+// is lost, and reports the addresses from the header, if it carried any,
+// as its remote and local addresses.
+//
+// If conn does not start with a header, readProxyHeader returns
+// errNoProxyHeader along with a conn that replays everything read so far.
+// A second header right behind the first is an error; only what arrived
+// along with the first is checked, so as not to wait for client data.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+	replay := func() *prefixConn {
+		buffered, _ := br.Peek(br.Buffered())
+		return &prefixConn{Conn: conn, prefix: buffered}
+	}
+
+	// Read just enough to tell which version, if any, this is
+	for n := 1; ; n++ {
+		b, err := br.Peek(n)
+		if err != nil {
+			return replay(), err
+		}
+		v1 := bytes.HasPrefix([]byte("PROXY "), b) || bytes.HasPrefix(b, []byte("PROXY "))
+		v2 := bytes.HasPrefix([]byte(proxyV2Signature), b) || bytes.HasPrefix(b, []byte(proxyV2Signature))
+		switch {
+		case !v1 && !v2:
+			return replay(), errNoProxyHeader
+		case v1 && n >= len("PROXY "):
+			src, dst, err := parseProxyV1(br)
+			if err != nil {
+				return nil, err
+			}
+			if doubledProxyHeader(br) {
+				return nil, errDoubledProxyHeader
+			}
+			pc := replay()
+			pc.remote, pc.local = src, dst
+			return pc, nil
+		case v2 && n >= len(proxyV2Signature):
+			src, dst, err := parseProxyV2(br)
+			if err != nil {
+				return nil, err
+			}
+			if doubledProxyHeader(br) {
+				return nil, errDoubledProxyHeader
+			}
+			pc := replay()
+			pc.remote, pc.local = src, dst
+			return pc, nil
+		}
+	}
+}
+
+// doubledProxyHeader reports whether the bytes br has buffered start with
+// another PROXY protocol header.
+func doubledProxyHeader(br *bufio.Reader) bool {
+	rest, _ := br.Peek(br.Buffered())
+	return bytes.HasPrefix(rest, []byte("PROXY ")) || bytes.HasPrefix(rest, []byte(proxyV2Signature))
+}
+
+// parseProxyV1 reads a v1 header line. UNKNOWN headers yield nil addresses.
+func parseProxyV1(br *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyV1Length {
+			return nil, nil, errors.New("malformed PROXY v1 header: line too long")
+		}
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed PROXY v1 header: %v", err)
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// parseProxyV2 reads a v2 header. LOCAL and non-TCP headers yield nil
+// addresses.
+func parseProxyV2(br *bufio.Reader) (src, dst net.Addr, err error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(br, fixed[:]); err != nil {
+		return nil, nil, fmt.Errorf("malformed PROXY v2 header: %v", err)
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("malformed PROXY v2 header: version %d", fixed[12]>>4)
+	}
+	command, family := fixed[12]&0x0f, fixed[13]
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, fmt.Errorf("malformed PROXY v2 header: %v", err)
+	}
+
+	switch command {
+	case 0x0: // LOCAL: the connection's own addresses apply
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("malformed PROXY v2 header: command %d", command)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		ipLen = net.IPv4len
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errors.New("malformed PROXY v2 header: address block too short")
+	}
+	srcIP := net.IP(body[:ipLen])
+	dstIP := net.IP(body[ipLen : 2*ipLen])
+	ports := body[2*ipLen:]
+	return &net.TCPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(ports[0:2]))},
+		&net.TCPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(ports[2:4]))}, nil
+}
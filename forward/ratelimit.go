@@ -0,0 +1,86 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket refilled at rate tokens per second that
+// holds at most one second's worth of tokens. A token is a byte, or a
+// connection for AcceptRate. It is safe for concurrent use, so one
+// limiter can be shared by many connections.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perSec int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(perSec),
+		tokens: float64(perSec),
+		last:   time.Now(),
+	}
+}
+
+// burst is the most bytes a single read should take from the bucket.
+func (l *rateLimiter) burst() int {
+	return max(int(l.rate), 1)
+}
+
+// wait takes n tokens from the bucket, blocking until the bucket has paid
+// them back or ctx is done. The bucket may go into debt, which later
+// callers wait out, so large reads are throttled rather than refused.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// limitedReader throttles reads from r through every limiter in limiters.
+// Holding data back while waiting lets TCP flow control slow the sender
+// down instead of dropping anything.
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	for _, l := range lr.limiters {
+		if b := l.burst(); len(p) > b {
+			p = p[:b]
+		}
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		for _, l := range lr.limiters {
+			if werr := l.wait(lr.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
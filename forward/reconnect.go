@@ -0,0 +1,135 @@
+package forward
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// reconnectingConn is a connection to a target that, for ReconnectTarget,
+// dials a new one in its place when the target closes it while the
+// client is still connected. Nothing is buffered or replayed across the
+// switch: the client's stream simply continues on the new connection.
+type reconnectingConn struct {
+	// redial connects to a target for the nth reconnection, counting
+	// from 1.
+	redial func(n int) (net.Conn, error)
+
+	max int // reconnections allowed
+
+	mu      sync.Mutex
+	conn    net.Conn
+	n       int  // reconnections so far
+	done    bool // the client has finished sending, or the connection is closed
+	readDL  time.Time
+	writeDL time.Time
+}
+
+func (c *reconnectingConn) current() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// Read reads from the current connection. When the target closes it, a
+// new connection takes its place if reconnections are left and the client
+// has not finished sending; otherwise Read reports EOF.
+func (c *reconnectingConn) Read(p []byte) (int, error) {
+	for {
+		conn := c.current()
+		n, err := conn.Read(p)
+		if n > 0 || err != io.EOF || !c.replace(conn) {
+			return n, err
+		}
+	}
+}
+
+// replace dials a connection to stand in for old, which the target has
+// closed, and reports whether it did.
+func (c *reconnectingConn) replace(old net.Conn) bool {
+	c.mu.Lock()
+	if c.done || c.n >= c.max {
+		c.mu.Unlock()
+		return false
+	}
+	c.n++
+	n := c.n
+	c.mu.Unlock()
+
+	// The lock is not held while dialing, so cancelling the connection
+	// through its deadlines is not held up
+	conn, err := c.redial(n)
+	if err != nil {
+		return false
+	}
+
+	c.mu.Lock()
+	if c.done {
+		c.mu.Unlock()
+		conn.Close()
+		return false
+	}
+	c.conn = conn
+	conn.SetReadDeadline(c.readDL)
+	conn.SetWriteDeadline(c.writeDL)
+	c.mu.Unlock()
+	old.Close()
+	return true
+}
+
+// Write writes to the current connection. A write that fails because its
+// connection was just replaced is retried on the new one.
+func (c *reconnectingConn) Write(p []byte) (int, error) {
+	conn := c.current()
+	n, err := conn.Write(p)
+	if err != nil && n == 0 {
+		if next := c.current(); next != conn {
+			return next.Write(p)
+		}
+	}
+	return n, err
+}
+
+// CloseWrite passes the client's EOF on to the target; the connection is
+// no longer replaced from then on, as the client has nothing more to say.
+func (c *reconnectingConn) CloseWrite() error {
+	c.mu.Lock()
+	c.done = true
+	conn := c.conn
+	c.mu.Unlock()
+	closeWrite(conn)
+	return nil
+}
+
+func (c *reconnectingConn) Close() error {
+	c.mu.Lock()
+	c.done = true
+	conn := c.conn
+	c.mu.Unlock()
+	return conn.Close()
+}
+
+func (c *reconnectingConn) LocalAddr() net.Addr  { return c.current().LocalAddr() }
+func (c *reconnectingConn) RemoteAddr() net.Addr { return c.current().RemoteAddr() }
+
+func (c *reconnectingConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDL, c.writeDL = t, t
+	return c.conn.SetDeadline(t)
+}
+
+func (c *reconnectingConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDL = t
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *reconnectingConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDL = t
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,98 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dnsCache resolves target host names and remembers the answers for ttl,
+// handing out the addresses of each name round-robin.
+type dnsCache struct {
+	ttl      time.Duration
+	resolver *net.Resolver
+
+	mu    sync.Mutex
+	hosts map[string]*dnsEntry // by family and host name, e.g. "ip4 example.com"
+}
+
+// dnsEntry holds the cached addresses of one host. mu is held while the
+// host is being looked up, so concurrent dials wait for a single lookup
+// instead of each sending their own.
+type dnsEntry struct {
+	mu      sync.Mutex
+	addrs   []string
+	expires time.Time
+	next    atomic.Uint64
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:      ttl,
+		resolver: net.DefaultResolver,
+		hosts:    make(map[string]*dnsEntry),
+	}
+}
+
+// resolve returns address with its host replaced by one of the host's
+// addresses of the family network is limited to, if any, e.g. IPv4 only
+// for "tcp4". Addresses that are already IPs, or that cannot be split,
+// are returned unchanged. When a refresh fails, the previous answer is
+// kept for another ttl and the lookup error is returned as stale.
+func (c *dnsCache) resolve(ctx context.Context, network, address string) (resolved string, stale error, err error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return address, nil, nil
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return address, nil, nil
+	}
+
+	family := "ip"
+	switch {
+	case strings.HasSuffix(network, "4"):
+		family = "ip4"
+	case strings.HasSuffix(network, "6"):
+		family = "ip6"
+	}
+
+	key := family + " " + host
+	c.mu.Lock()
+	e, ok := c.hosts[key]
+	if !ok {
+		e = &dnsEntry{}
+		c.hosts[key] = e
+	}
+	c.mu.Unlock()
+
+	e.mu.Lock()
+	if time.Now().After(e.expires) {
+		ips, lerr := c.resolver.LookupNetIP(ctx, family, host)
+		addrs := make([]string, len(ips))
+		for i, ip := range ips {
+			addrs[i] = ip.Unmap().String()
+		}
+		if lerr == nil && len(addrs) == 0 {
+			lerr = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+		}
+		switch {
+		case lerr == nil:
+			e.addrs, e.expires = addrs, time.Now().Add(c.ttl)
+		case len(e.addrs) == 0:
+			e.mu.Unlock()
+			return "", nil, lerr
+		default:
+			e.expires = time.Now().Add(c.ttl)
+			stale = lerr
+		}
+	}
+	addrs := e.addrs
+	e.mu.Unlock()
+
+	ip := addrs[(e.next.Add(1)-1)%uint64(len(addrs))]
+	return net.JoinHostPort(ip, port), stale, nil
+}
@@ -0,0 +1,32 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package forward
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// reusePortControl sets SO_REUSEADDR and SO_REUSEPORT on a TCP or UDP
+// listening socket so another process can bind the same address. It is a
+// variable so that platforms without SO_REUSEPORT can leave it nil.
+var reusePortControl = func(network, address string, c syscall.RawConn) error {
+	if strings.HasPrefix(network, "unix") {
+		return nil
+	}
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			sockErr = fmt.Errorf("failed to set SO_REUSEADDR: %v", err)
+			return
+		}
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+			sockErr = fmt.Errorf("failed to set SO_REUSEPORT: %v", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,8 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package forward
+
+import "syscall"
+
+// reusePortControl is nil where SO_REUSEPORT is not available.
+var reusePortControl func(network, address string, c syscall.RawConn) error
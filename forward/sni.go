@@ -0,0 +1,43 @@
+package forward
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// errHelloRead aborts the handshake in peekServerName once the ClientHello
+// has been parsed.
+var errHelloRead = errors.New("ClientHello read")
+
+// helloConn feeds a handshake from r and discards whatever the TLS stack
+// tries to send back, so the real client never sees it.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (helloConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// peekServerName reads the TLS ClientHello from conn and returns the server
+// name it asks for, or "" if conn does not open with a ClientHello or it
+// has no server name. The returned connection replays everything that was
+// read, so the handshake can still complete with the target.
+func peekServerName(conn net.Conn) (net.Conn, string) {
+	var buf bytes.Buffer
+	var name string
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	tls.Server(helloConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	return &prefixConn{Conn: conn, prefix: buf.Bytes()}, name
+}
@@ -0,0 +1,107 @@
+package forward
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedTLS returns a server config with a throwaway certificate.
+func selfSignedTLS(tb testing.TB) *tls.Config {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"api.example.com", "www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// listenTag starts a loopback TCP server that greets every connection
+// with tag, as a server speaking first would, then discards what it
+// reads, until the test ends.
+func listenTag(tb testing.TB, tag string) string {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.WriteString(c, tag)
+				io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestRoutesWithTLSTermination(t *testing.T) {
+	f := newTestForwarder(listenTag(t, "default"))
+	f.TLSConfig = selfSignedTLS(t)
+	f.SNIRoutes = map[string][]string{"api.example.com": {listenTag(t, "sni")}}
+	f.ProtocolRoutes = map[string][]string{SniffHTTP: {listenTag(t, "http")}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, f, l)
+
+	for _, tc := range []struct {
+		name       string
+		serverName string
+		send       string
+		want       string
+	}{
+		{"SNI wins over protocol", "api.example.com", "GET / HTTP/1.1\r\n\r\n", "sni"},
+		{"protocol", "www.example.com", "GET / HTTP/1.1\r\n\r\n", "http"},
+		// Once sniffing gives up, the server name is already known, so
+		// there is no wait for a ClientHello on top
+		{"SNI with server speaking first", "api.example.com", "", "sni"},
+		{"default", "www.example.com", "", "default"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer raw.Close()
+			conn := tls.Client(raw, &tls.Config{ServerName: tc.serverName, InsecureSkipVerify: true})
+			start := time.Now()
+			conn.SetDeadline(start.Add(handshakeTimeout / 2))
+			if _, err := io.WriteString(conn, tc.send); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(tc.want))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatalf("read after %v: %v", time.Since(start), err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("routed to %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package forward
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Protocols that ProtocolRoutes can route by.
+const (
+	SniffTLS  = "tls"
+	SniffSSH  = "ssh"
+	SniffHTTP = "http"
+)
+
+// sniffTimeout bounds how long a client may take to send the bytes that
+// identify its protocol. Clients of protocols where the server speaks
+// first send nothing, and go to the default targets once it expires.
+const sniffTimeout = 2 * time.Second
+
+// signatures are the opening bytes of each protocol ProtocolRoutes knows:
+// a TLS handshake record, the SSH identification string and the request
+// methods of HTTP/1, plus the HTTP/2 connection preface.
+var signatures = []struct {
+	protocol string
+	prefix   []byte
+}{
+	{SniffTLS, []byte{0x16, 0x03}},
+	{SniffSSH, []byte("SSH-")},
+	{SniffHTTP, []byte("GET ")},
+	{SniffHTTP, []byte("HEAD ")},
+	{SniffHTTP, []byte("POST ")},
+	{SniffHTTP, []byte("PUT ")},
+	{SniffHTTP, []byte("DELETE ")},
+	{SniffHTTP, []byte("OPTIONS ")},
+	{SniffHTTP, []byte("PATCH ")},
+	{SniffHTTP, []byte("CONNECT ")},
+	{SniffHTTP, []byte("TRACE ")},
+	{SniffHTTP, []byte("PRI ")},
+}
+
+// maxSniff is the length of the longest signature.
+const maxSniff = len("OPTIONS ")
+
+// ParseSniffProtocol validates the name of a protocol ProtocolRoutes can
+// route by.
+func ParseSniffProtocol(s string) (string, error) {
+	switch s {
+	case SniffTLS, SniffSSH, SniffHTTP:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown protocol %q (want tls, ssh or http)", s)
+	}
+}
+
+// classify returns the protocol whose signature p opens with. done is
+// false while p is too short to tell.
+func classify(p []byte) (protocol string, done bool) {
+	pending := false
+	for _, s := range signatures {
+		n := min(len(p), len(s.prefix))
+		if !bytes.Equal(p[:n], s.prefix[:n]) {
+			continue
+		}
+		if n == len(s.prefix) {
+			return s.protocol, true
+		}
+		pending = true
+	}
+	return "", !pending
+}
+
+// sniffProtocol reads the first bytes of conn until they identify its
+// protocol or cannot, and returns that protocol, or "" if none matched.
+// The returned connection replays everything that was read.
+func sniffProtocol(conn net.Conn) (net.Conn, string) {
+	buf := make([]byte, 0, maxSniff)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	var protocol string
+	for {
+		var done bool
+		if protocol, done = classify(buf); done {
+			break
+		}
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			protocol, _ = classify(buf)
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	return &prefixConn{Conn: conn, prefix: buf}, protocol
+}
@@ -0,0 +1,33 @@
+//go:build !unix
+
+package forward
+
+import (
+	"fmt"
+	"net"
+)
+
+// setSocketBuffers sets the receive and send buffers of conn using the
+// portable net.TCPConn methods. A size of 0 leaves that buffer at the OS
+// default.
+func setSocketBuffers(conn *net.TCPConn, rcvbuf, sndbuf int) error {
+	if rcvbuf > 0 {
+		if err := conn.SetReadBuffer(rcvbuf); err != nil {
+			return fmt.Errorf("failed to set receive buffer: %v", err)
+		}
+	}
+	if sndbuf > 0 {
+		if err := conn.SetWriteBuffer(sndbuf); err != nil {
+			return fmt.Errorf("failed to set send buffer: %v", err)
+		}
+	}
+	return nil
+}
+
+// setDSCP is nil where DSCP marking is not supported.
+var setDSCP func(conn *net.TCPConn, dscp int) error
+
+// setBacklog is nil where the listen backlog cannot be changed.
+var setBacklog func(l *net.TCPListener, backlog int) error
+
+func maxBacklog() int { return 0 }
@@ -0,0 +1,121 @@
+//go:build unix
+
+package forward
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setSocketBuffers sets SO_RCVBUF and SO_SNDBUF on conn. A size of 0
+// leaves that buffer at the OS default.
+func setSocketBuffers(conn *net.TCPConn, rcvbuf, sndbuf int) error {
+	if rcvbuf == 0 && sndbuf == 0 {
+		return nil
+	}
+
+	// Work on the connection's own descriptor: conn.File() would dup it
+	// for every connection and put it into blocking mode
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to get raw connection: %v", err)
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if rcvbuf > 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvbuf); err != nil {
+				sockErr = fmt.Errorf("failed to set SO_RCVBUF: %v", err)
+				return
+			}
+		}
+		if sndbuf > 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, sndbuf); err != nil {
+				sockErr = fmt.Errorf("failed to set SO_SNDBUF: %v", err)
+			}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to access socket: %v", err)
+	}
+	return sockErr
+}
+
+// setDSCP marks the packets of conn with the DSCP code point dscp, using
+// IP_TOS on IPv4 sockets and IPV6_TCLASS on IPv6 ones. It is a variable
+// so that platforms without those options can leave it nil.
+var setDSCP = func(conn *net.TCPConn, dscp int) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to get raw connection: %v", err)
+	}
+
+	// The low two bits of the byte belong to ECN
+	tos := dscp << 2
+	addr, _ := conn.LocalAddr().(*net.TCPAddr)
+	mapped := addr != nil && addr.IP.To4() != nil
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sa, err := syscall.Getsockname(int(fd))
+		if err != nil {
+			sockErr = fmt.Errorf("failed to get socket address: %v", err)
+			return
+		}
+		if _, ok := sa.(*syscall.SockaddrInet4); ok {
+			if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos); err != nil {
+				sockErr = fmt.Errorf("failed to set IP_TOS: %v", err)
+			}
+			return
+		}
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos); err != nil {
+			sockErr = fmt.Errorf("failed to set IPV6_TCLASS: %v", err)
+			return
+		}
+		// An IPv4 peer on a dual-stack socket gets IPv4 packets, which
+		// Linux marks from IP_TOS; elsewhere the option may not apply
+		if mapped {
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to access socket: %v", err)
+	}
+	return sockErr
+}
+
+// setBacklog resizes the accept queue of l to backlog connections by
+// calling listen(2) again on its socket, which Linux and the BSDs allow
+// on a socket that is already listening. It is a variable so that
+// platforms where this does not work can leave it nil.
+var setBacklog = func(l *net.TCPListener, backlog int) error {
+	rawConn, err := l.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to get raw listener: %v", err)
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if err := syscall.Listen(int(fd), backlog); err != nil {
+			sockErr = fmt.Errorf("failed to set listen backlog: %v", err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to access socket: %v", err)
+	}
+	return sockErr
+}
+
+// maxBacklog returns the limit the kernel silently caps listen backlogs
+// at, or 0 if it is not known.
+func maxBacklog() int {
+	b, err := os.ReadFile("/proc/sys/net/core/somaxconn")
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n
+}
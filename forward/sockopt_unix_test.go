@@ -0,0 +1,55 @@
+//go:build unix
+
+package forward
+
+import (
+	"bytes"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSocketBuffersForward(t *testing.T) {
+	const size = 64 * 1024
+	d := &recordingDialer{}
+	f := newTestForwarder(listenEcho(t).Addr().String())
+	f.Dialer = d
+	f.RecvBuffer, f.SendBuffer = size, size
+	f.IdleTimeout = 200 * time.Millisecond
+	conn := serveTCP(t, f)
+
+	// Several times the buffers, so the copies have to wait on the
+	// poller for room and for data
+	echo(t, conn, bytes.Repeat([]byte("0123456789abcdef"), 4*1024*1024/16))
+
+	rawConn, err := d.last(t).(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawConn.Control(func(fd uintptr) {
+		for _, opt := range []struct {
+			name string
+			opt  int
+		}{{"SO_RCVBUF", syscall.SO_RCVBUF}, {"SO_SNDBUF", syscall.SO_SNDBUF}} {
+			// Linux reports twice the size set, for its bookkeeping
+			got, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt.opt)
+			if err != nil {
+				t.Errorf("%s: %v", opt.name, err)
+			} else if got < size || got > 2*size {
+				t.Errorf("%s = %d, want %d", opt.name, got, size)
+			}
+		}
+	})
+
+	// Deadlines only work while the descriptor stays non-blocking under
+	// the runtime poller, so the idle timeout proves it does
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read %d bytes, %v; want the idle connection closed", n, err)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("idle connection closed after %v, want about %v", waited, f.IdleTimeout)
+	}
+}
@@ -0,0 +1,193 @@
+package forward
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants from RFC 1928 and RFC 1929.
+const (
+	socks5Version     = 0x05
+	socks5AuthNone    = 0x00
+	socks5AuthUser    = 0x02
+	socks5AuthNoMatch = 0xff
+	socks5Connect     = 0x01
+	socks5AddrIPv4    = 0x01
+	socks5AddrDomain  = 0x03
+	socks5AddrIPv6    = 0x04
+)
+
+// socks5Replies describes the failure codes a SOCKS5 proxy may answer a
+// CONNECT with.
+var socks5Replies = map[byte]string{
+	0x01: "general failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Dialer connects to TCP addresses through a SOCKS5 proxy, which it
+// reaches with dialer. Host names are passed to the proxy to resolve.
+type socks5Dialer struct {
+	proxy          string
+	user, password string
+	dialer         Dialer
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("SOCKS5 proxy %s: cannot dial %s address %s", d.proxy, network, address)
+	}
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5 proxy: %w", err)
+	}
+
+	// The handshake is bounded by ctx like the dial to the proxy
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	err = d.handshake(conn, address)
+	if !stop() || err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %w", d.proxy, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// handshake authenticates with the proxy and asks it to connect to
+// address.
+func (d *socks5Dialer) handshake(conn net.Conn, address string) error {
+	req, err := socks5Request(address)
+	if err != nil {
+		return err
+	}
+
+	method := byte(socks5AuthNone)
+	if d.user != "" || d.password != "" {
+		method = socks5AuthUser
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", resp[0])
+	}
+	switch resp[1] {
+	case method:
+	case socks5AuthNoMatch:
+		if method == socks5AuthUser {
+			return errors.New("proxy does not accept username/password authentication")
+		}
+		return errors.New("proxy requires authentication")
+	default:
+		return fmt.Errorf("proxy chose unexpected authentication method %d", resp[1])
+	}
+
+	if method == socks5AuthUser {
+		if len(d.user) > 255 || len(d.password) > 255 {
+			return errors.New("username and password must be at most 255 bytes")
+		}
+		auth := []byte{0x01, byte(len(d.user))}
+		auth = append(auth, d.user...)
+		auth = append(auth, byte(len(d.password)))
+		auth = append(auth, d.password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return err
+		}
+		if resp[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", reply[0])
+	}
+	if reply[1] != 0 {
+		if msg, ok := socks5Replies[reply[1]]; ok {
+			return fmt.Errorf("connecting to %s: %s", address, msg)
+		}
+		return fmt.Errorf("connecting to %s: error code %d", address, reply[1])
+	}
+
+	// Skip the address the proxy bound for the connection
+	var skip int
+	switch reply[3] {
+	case socks5AddrIPv4:
+		skip = 4
+	case socks5AddrIPv6:
+		skip = 16
+	case socks5AddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("unknown address type %d in reply", reply[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(skip+2))
+	return err
+}
+
+// socks5Request builds the CONNECT request for a host:port address.
+func socks5Request(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", address)
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			req = append(req, socks5AddrIPv4)
+		} else {
+			req = append(req, socks5AddrIPv6)
+		}
+		req = append(req, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	return binary.BigEndian.AppendUint16(req, uint16(port)), nil
+}
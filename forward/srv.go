@@ -0,0 +1,113 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// srvScheme marks a target that is discovered through a DNS SRV record,
+// e.g. srv://_app._tcp.service.consul.
+const srvScheme = "srv://"
+
+// DefaultSRVRefresh is how often SRV records are queried again when
+// DNSTTL is not set.
+const DefaultSRVRefresh = 30 * time.Second
+
+// srvCache looks up SRV records and remembers the answers for ttl.
+type srvCache struct {
+	ttl      time.Duration
+	resolver *net.Resolver
+
+	mu    sync.Mutex
+	names map[string]*srvEntry
+}
+
+// srvEntry holds the cached records of one SRV name; mu is held during
+// the lookup, like dnsEntry.
+type srvEntry struct {
+	mu      sync.Mutex
+	records []*net.SRV // sorted by priority
+	expires time.Time
+}
+
+func newSRVCache(ttl time.Duration) *srvCache {
+	return &srvCache{
+		ttl:      ttl,
+		resolver: net.DefaultResolver,
+		names:    make(map[string]*srvEntry),
+	}
+}
+
+// resolve picks a host:port for the SRV name in target, which must start
+// with srv://. Only records of the best (lowest) priority are considered,
+// and among those one is chosen at random in proportion to its weight.
+// A failed refresh keeps the previous records for another ttl and is
+// returned as stale.
+func (c *srvCache) resolve(ctx context.Context, target string) (addr string, stale error, err error) {
+	name := strings.TrimPrefix(target, srvScheme)
+
+	c.mu.Lock()
+	e, ok := c.names[name]
+	if !ok {
+		e = &srvEntry{}
+		c.names[name] = e
+	}
+	c.mu.Unlock()
+
+	e.mu.Lock()
+	if time.Now().After(e.expires) {
+		// An empty service and proto make LookupSRV query name as is
+		_, records, lerr := c.resolver.LookupSRV(ctx, "", "", name)
+		if lerr == nil && len(records) == 0 {
+			lerr = &net.DNSError{Err: "no SRV records", Name: name, IsNotFound: true}
+		}
+		switch {
+		case lerr == nil:
+			e.records, e.expires = records, time.Now().Add(c.ttl)
+		case len(e.records) == 0:
+			e.mu.Unlock()
+			return "", nil, fmt.Errorf("looking up %s: %w", target, lerr)
+		default:
+			e.expires = time.Now().Add(c.ttl)
+			stale = lerr
+		}
+	}
+	records := e.records
+	e.mu.Unlock()
+
+	rec := pickSRV(records)
+	return net.JoinHostPort(strings.TrimSuffix(rec.Target, "."), strconv.Itoa(int(rec.Port))), stale, nil
+}
+
+// pickSRV chooses a record from the best priority group of records,
+// which the resolver returns sorted by priority, weighting the choice by
+// each record's weight as described in RFC 2782.
+func pickSRV(records []*net.SRV) *net.SRV {
+	best := records[0].Priority
+	var group []*net.SRV
+	total := 0
+	for _, r := range records {
+		if r.Priority != best {
+			break
+		}
+		group = append(group, r)
+		total += int(r.Weight)
+	}
+	if total == 0 {
+		return group[rand.IntN(len(group))]
+	}
+	n := rand.IntN(total)
+	for _, r := range group {
+		if n < int(r.Weight) {
+			return r
+		}
+		n -= int(r.Weight)
+	}
+	return group[len(group)-1]
+}
@@ -0,0 +1,169 @@
+package forward
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of a Forwarder's traffic counters. For UDP, each
+// client session counts as a connection.
+type Stats struct {
+	Accepted uint64 // connections accepted on the source
+	Failed   uint64 // connections rejected or never connected to a target
+	Active   int64  // connections currently being forwarded
+
+	BytesSent     uint64 // bytes forwarded from clients to targets
+	BytesReceived uint64 // bytes forwarded from targets to clients
+}
+
+// counters holds the live values behind Stats.
+type counters struct {
+	accepted      atomic.Uint64
+	failed        atomic.Uint64
+	active        atomic.Int64
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+
+	// copiedIn and copiedOut count the bytes from and to clients as they
+	// are copied, for StatsInterval
+	copiedIn  atomic.Int64
+	copiedOut atomic.Int64
+}
+
+// Stats returns the forwarder's counters. They accumulate over the
+// lifetime of the Forwarder, across calls to Run. Bytes of a TCP
+// connection are counted as each direction finishes.
+func (f *Forwarder) Stats() Stats {
+	return Stats{
+		Accepted:      f.stats.accepted.Load(),
+		Failed:        f.stats.failed.Load(),
+		Active:        f.stats.active.Load(),
+		BytesSent:     f.stats.bytesSent.Load(),
+		BytesReceived: f.stats.bytesReceived.Load(),
+	}
+}
+
+// ConnStats describes an open TCP connection, as listed by Conns.
+type ConnStats struct {
+	ID       uint64
+	Client   string
+	Target   string
+	BytesIn  int64 // read from the client
+	BytesOut int64 // written to the client
+	Accepted time.Time
+}
+
+// liveConn is the registry entry of a connection that reached a target.
+type liveConn struct {
+	client, target string
+	accepted       time.Time
+	in, out        atomic.Int64
+
+	// cancel ends the connection; closed tells CloseConn's doing apart
+	// from other cancellations
+	cancel context.CancelFunc
+	closed atomic.Bool
+}
+
+// connRegistry holds the connections of a forwarder that are being
+// forwarded, by ID.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[uint64]*liveConn
+}
+
+func (r *connRegistry) add(id uint64, c *liveConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns == nil {
+		r.conns = make(map[uint64]*liveConn)
+	}
+	r.conns[id] = c
+}
+
+func (r *connRegistry) remove(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, id)
+}
+
+// Conns returns the TCP connections currently being forwarded, ordered
+// by ID. Their byte counts are only updated as each direction finishes,
+// unless LiveBytes is set. UDP sessions are not listed.
+func (f *Forwarder) Conns() []ConnStats {
+	f.registry.mu.Lock()
+	defer f.registry.mu.Unlock()
+	out := make([]ConnStats, 0, len(f.registry.conns))
+	for id, c := range f.registry.conns {
+		out = append(out, ConnStats{
+			ID:       id,
+			Client:   c.client,
+			Target:   c.target,
+			BytesIn:  c.in.Load(),
+			BytesOut: c.out.Load(),
+			Accepted: c.accepted,
+		})
+	}
+	slices.SortFunc(out, func(a, b ConnStats) int { return cmp.Compare(a.ID, b.ID) })
+	return out
+}
+
+// CloseConn closes both sides of the TCP connection with the given ID,
+// as listed by Conns, and reports whether it was open. The connection
+// ends with its usual log line and OnClose call.
+func (f *Forwarder) CloseConn(id uint64) bool {
+	f.registry.mu.Lock()
+	c, ok := f.registry.conns[id]
+	f.registry.mu.Unlock()
+	if !ok {
+		return false
+	}
+	c.closed.Store(true)
+	c.cancel()
+	return true
+}
+
+// countingReader adds the bytes read from r to n as they are read.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// logThroughput logs the forwarder's throughput every StatsInterval until
+// ctx is done.
+func (f *Forwarder) logThroughput(ctx context.Context) {
+	ticker := time.NewTicker(f.StatsInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	lastIn, lastOut := f.stats.copiedIn.Load(), f.stats.copiedOut.Load()
+	lastAccepted := f.stats.accepted.Load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		in, out := f.stats.copiedIn.Load(), f.stats.copiedOut.Load()
+		accepted := f.stats.accepted.Load()
+		secs := now.Sub(last).Seconds()
+		f.logger.Info("Throughput",
+			"in_bytes_per_sec", int64(float64(in-lastIn)/secs),
+			"out_bytes_per_sec", int64(float64(out-lastOut)/secs),
+			"accepted", accepted-lastAccepted,
+			"active", f.stats.active.Load())
+		last, lastIn, lastOut, lastAccepted = now, in, out, accepted
+	}
+}
@@ -0,0 +1,44 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// targetHandshake runs a TLS client handshake with backend b over conn,
+// bounded by DialTimeout.
+func (f *Forwarder) targetHandshake(ctx context.Context, conn net.Conn, b *backend) (*tls.Conn, error) {
+	config := f.TargetTLSConfig
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(b.addr); err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+
+	if f.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.DialTimeout)
+		defer cancel()
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// tlsError adds the subject and issuer of the offending certificate to a
+// failed verification, which is what is needed to track down a
+// misconfigured peer.
+func tlsError(err error) error {
+	var verr *tls.CertificateVerificationError
+	if errors.As(err, &verr) && len(verr.UnverifiedCertificates) > 0 {
+		cert := verr.UnverifiedCertificates[0]
+		return fmt.Errorf("%v (subject %q, issuer %q)", err, cert.Subject, cert.Issuer)
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package forward
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+var errSelfDestination = errors.New("connection is addressed to the forwarder itself")
+
+// netConn returns the connection underneath any TLS or PROXY header
+// wrapping of conn.
+func netConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *prefixConn:
+			conn = c.Conn
+		default:
+			return conn
+		}
+	}
+}
+
+// originalDstBalancer returns a balancer over the address conn was
+// originally sent to, for Transparent mode.
+func (f *Forwarder) originalDstBalancer(conn net.Conn) (*balancer, error) {
+	tcpConn, ok := netConn(conn).(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("transparent mode needs a TCP connection")
+	}
+	dst, err := originalDst(tcpConn)
+	if err != nil {
+		return nil, err
+	}
+	// A client that connects to the listener directly would otherwise
+	// be forwarded back to it, over and over
+	for _, self := range f.self {
+		self = netip.AddrPortFrom(self.Addr().Unmap(), self.Port())
+		if dst.Port() == self.Port() && (dst.Addr() == self.Addr() || self.Addr().IsUnspecified()) {
+			return nil, errSelfDestination
+		}
+	}
+	b, err := newBalancer([]string{dst.String()}, "tcp")
+	if err != nil {
+		return nil, err
+	}
+	b.logger = f.logger
+	return b, nil
+}
+
+// transparentDialer returns a Dialer that connects from client's IP, so
+// the target sees the original client as the source.
+func (f *Forwarder) transparentDialer(client net.Addr) Dialer {
+	if f.Dialer != nil {
+		return f.Dialer
+	}
+	d := &net.Dialer{FallbackDelay: f.DialFallbackDelay, Control: transparentControl}
+	if addr, ok := client.(*net.TCPAddr); ok {
+		d.LocalAddr = &net.TCPAddr{IP: addr.IP, Zone: addr.Zone}
+	}
+	return d
+}
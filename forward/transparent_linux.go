@@ -0,0 +1,78 @@
+//go:build linux
+
+package forward
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+const (
+	// ipv6Transparent is IPV6_TRANSPARENT, which syscall does not define.
+	ipv6Transparent = 75
+	// soOriginalDst is SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST at the
+	// IPv6 level, from the netfilter headers.
+	soOriginalDst = 80
+)
+
+// transparentControl sets IP_TRANSPARENT, or IPV6_TRANSPARENT on IPv6
+// sockets, so a listener accepts connections addressed to any IP and a
+// dialer can bind a non-local source address. Both need CAP_NET_ADMIN.
+var transparentControl = func(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		level, opt, name := syscall.SOL_IP, syscall.IP_TRANSPARENT, "IP_TRANSPARENT"
+		if sa, err := syscall.Getsockname(int(fd)); err == nil {
+			if _, ok := sa.(*syscall.SockaddrInet6); ok {
+				level, opt, name = syscall.SOL_IPV6, ipv6Transparent, "IPV6_TRANSPARENT"
+			}
+		}
+		if err := syscall.SetsockoptInt(int(fd), level, opt, 1); err != nil {
+			sockErr = fmt.Errorf("failed to set %s: %v", name, err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// originalDst returns the address conn was sent to before an iptables
+// REDIRECT rewrote it. Connections intercepted with TPROXY keep their
+// destination, so when the kernel has no NAT record for conn its local
+// address is the original destination.
+func originalDst(conn *net.TCPConn) (netip.AddrPort, error) {
+	local := conn.LocalAddr().(*net.TCPAddr).AddrPort()
+	local = netip.AddrPortFrom(local.Addr().Unmap(), local.Port())
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed to get raw connection: %v", err)
+	}
+	dst := local
+	err = rawConn.Control(func(fd uintptr) {
+		// The sockaddr_in and sockaddr_in6 the kernel fills in fit the
+		// option structs that syscall has getters for
+		if local.Addr().Is4() {
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if err == nil {
+				ip := netip.AddrFrom4([4]byte(mreq.Multiaddr[4:8]))
+				dst = netip.AddrPortFrom(ip, binary.BigEndian.Uint16(mreq.Multiaddr[2:4]))
+			}
+			return
+		}
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+		if err == nil {
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), binary.BigEndian.Uint16(port[:]))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed to access socket: %v", err)
+	}
+	return dst, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package forward
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// transparentControl is nil where transparent proxying is not available.
+var transparentControl func(network, address string, c syscall.RawConn) error
+
+func originalDst(conn *net.TCPConn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("transparent mode is only supported on Linux")
+}
@@ -0,0 +1,249 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxDatagramSize = 64 * 1024
+
+// udpSession relays datagrams between one client and its own socket to
+// the target.
+type udpSession struct {
+	ready    chan struct{} // closed once conn and backend are set
+	conn     net.Conn
+	backend  *backend
+	logger   *slog.Logger // the forwarder's logger with the session ID
+	lastSeen atomic.Int64 // UnixNano of the last datagram in either direction
+}
+
+func (s *udpSession) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idleFor() time.Duration {
+	return time.Since(time.Unix(0, s.lastSeen.Load()))
+}
+
+// runUDP forwards the datagrams arriving on listener, or on a socket
+// bound to SourceAddr if it is nil.
+func (f *Forwarder) runUDP(ctx context.Context, listener net.PacketConn) error {
+	network, source := splitNetwork(f.SourceAddr, f.SourceNetwork)
+	network = f.withFamily(network)
+	if listener == nil && !isTCP(network) {
+		return fmt.Errorf("UDP forwarding requires a host:port source address")
+	}
+	if listener == nil && len(SplitTargets(f.SourceAddr)) > 1 {
+		return fmt.Errorf("UDP forwarding supports a single source address, got %s", f.SourceAddr)
+	}
+	for _, b := range f.balancer.backends {
+		if !isTCP(b.network) {
+			return fmt.Errorf("UDP forwarding requires host:port target addresses, got %s", b.addr)
+		}
+	}
+
+	if listener == nil {
+		lc := f.listenConfig()
+		var err error
+		if listener, err = lc.ListenPacket(ctx, udpNetwork(network), source); err != nil {
+			return fmt.Errorf("failed to start listener: %v", err)
+		}
+	}
+	defer listener.Close()
+	f.setListener(listener, []net.Addr{listener.LocalAddr()})
+	if f.draining.Load() {
+		listener.Close()
+	}
+	if err := f.checkLoops(ctx, []net.Addr{listener.LocalAddr()}); err != nil {
+		return err
+	}
+
+	attrs := []any{"network", "udp"}
+	if addr := listener.LocalAddr().String(); f.SourceAddr != "" && addr != f.SourceAddr {
+		attrs = append(attrs, "listen", addr)
+	}
+	f.logger.Info("Forwarding", append(attrs, "target", f.balancer.String())...)
+
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	defer stop()
+
+	var (
+		mu       sync.Mutex
+		sessions = make(map[string]*udpSession)
+		closing  bool // set under mu once the listener is done
+		wg       sync.WaitGroup
+		delay    time.Duration
+	)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, clientAddr, err := listener.ReadFrom(buf)
+		if err != nil {
+			// The socket is closed on shutdown and by Drain; only a close
+			// from elsewhere is worth an error
+			stopping := ctx.Err() != nil || f.draining.Load()
+			if !stopping && !errors.Is(err, net.ErrClosed) {
+				// Back off like acceptLoop so a persistent error does
+				// not spin the CPU
+				delay = min(max(2*delay, minAcceptRetryDelay), maxAcceptRetryDelay)
+				f.logger.Error("Error reading datagram", "error", err, "retry_in", delay)
+				t := time.NewTimer(delay)
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					t.Stop()
+				}
+				continue
+			}
+			if !stopping {
+				f.logger.Error("Listener closed, no longer accepting", "listen", listener.LocalAddr().String())
+			}
+			f.logger.Info("Shutting down listener")
+			mu.Lock()
+			closing = true
+			for _, sess := range sessions {
+				select {
+				case <-sess.ready:
+					sess.conn.Close()
+				default:
+					// Still dialing; it sees closing when done
+				}
+			}
+			mu.Unlock()
+			wg.Wait()
+			if f.draining.Load() {
+				// A drained forwarder keeps running until it is stopped
+				<-ctx.Done()
+			}
+			return nil
+		}
+
+		delay = 0
+
+		key := clientAddr.String()
+		mu.Lock()
+		sess, ok := sessions[key]
+		if !ok {
+			ci := f.newConnInfo()
+			f.stats.accepted.Add(1)
+			sess = &udpSession{ready: make(chan struct{}), logger: ci.logger}
+			sess.touch()
+			sessions[key] = sess
+			first := bytes.Clone(buf[:n])
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// Dial here rather than in the read loop, so a slow
+				// lookup for one client holds up no other session
+				targetConn, b, err := f.dialUDPTarget(ctx, sess.logger, clientIP(clientAddr))
+				mu.Lock()
+				if err != nil || closing {
+					delete(sessions, key)
+					mu.Unlock()
+					if err != nil {
+						f.stats.failed.Add(1)
+					} else {
+						targetConn.Close()
+					}
+					return
+				}
+				sess.conn, sess.backend = targetConn, b
+				close(sess.ready)
+				mu.Unlock()
+				sess.logger.Debug("New UDP session", "client", key)
+
+				f.stats.active.Add(1)
+				b.active.Add(1)
+				defer f.stats.active.Add(-1)
+				defer b.active.Add(-1)
+				f.sendUDP(sess, key, first)
+				f.relayUDP(listener, clientAddr, sess)
+
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+				targetConn.Close()
+			}()
+		}
+		mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		select {
+		case <-sess.ready:
+			f.sendUDP(sess, key, buf[:n])
+		default:
+			// As with a full socket buffer, datagrams arriving while the
+			// target is still being dialed are lost
+			sess.logger.Debug("Dropping datagram, still connecting to target", "client", key)
+		}
+	}
+}
+
+// sendUDP forwards a datagram from client to the target of sess.
+func (f *Forwarder) sendUDP(sess *udpSession, client string, p []byte) {
+	sess.touch()
+	if _, err := sess.conn.Write(p); err != nil {
+		sess.logger.Warn("Failed to forward datagram", "client", client, "error", err)
+		return
+	}
+	f.stats.bytesSent.Add(uint64(len(p)))
+	f.stats.copiedIn.Add(int64(len(p)))
+}
+
+// dialUDPTarget opens a socket to the backend that comes first for a
+// client from IP key, falling back to the following ones if that fails.
+func (f *Forwarder) dialUDPTarget(ctx context.Context, logger *slog.Logger, key string) (net.Conn, *backend, error) {
+	dialer := f.dialer()
+	var err error
+	for _, b := range f.balancer.order(key) {
+		var conn net.Conn
+		conn, err = f.dialAddr(ctx, logger, dialer, udpNetwork(b.network), b.addr, f.DialTimeout)
+		if err == nil {
+			return conn, b, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		logger.Warn("Failed to connect to target", "target", b.addr, "error", err)
+	}
+	return nil, nil, err
+}
+
+// relayUDP copies replies from the target back to the client until the
+// session has been idle for UDPTimeout or its socket is closed.
+func (f *Forwarder) relayUDP(listener net.PacketConn, clientAddr net.Addr, sess *udpSession) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		sess.conn.SetReadDeadline(time.Now().Add(f.UDPTimeout))
+		n, err := sess.conn.Read(buf)
+		if err != nil {
+			if isTimeout(err) {
+				if sess.idleFor() < f.UDPTimeout {
+					continue
+				}
+				sess.logger.Info("UDP session idle, closing", "client", clientAddr.String())
+			}
+			return
+		}
+
+		sess.touch()
+		if _, err := listener.WriteTo(buf[:n], clientAddr); err != nil {
+			sess.logger.Warn("Failed to send datagram", "client", clientAddr.String(), "error", err)
+			continue
+		}
+		f.stats.bytesReceived.Add(uint64(n))
+		f.stats.copiedOut.Add(int64(n))
+	}
+}
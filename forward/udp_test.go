@@ -0,0 +1,104 @@
+package forward
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// listenUDPEcho starts a loopback UDP server that sends every datagram
+// back after delay, until the test ends.
+func listenUDPEcho(tb testing.TB, delay time.Duration) string {
+	tb.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			time.Sleep(delay)
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// servePacket runs f.ServePacket on a loopback socket until the test ends
+// and returns the socket's address.
+func servePacket(tb testing.TB, f *Forwarder) string {
+	tb.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- f.ServePacket(pc) }()
+	for f.Addr() == nil {
+		select {
+		case err := <-done:
+			tb.Fatalf("ServePacket: %v", err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	tb.Cleanup(func() {
+		f.Stop()
+		if err := <-done; err != nil {
+			tb.Errorf("ServePacket: %v", err)
+		}
+	})
+	return pc.LocalAddr().String()
+}
+
+func TestUDPShortTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	f := newTestForwarder(listenUDPEcho(t, timeout/2))
+	f.Protocol = "udp"
+	f.UDPTimeout = timeout
+	conn, err := net.Dial("udp", servePacket(t, f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The reply comes back within the timeout, so the session must still
+	// be there for it; later on, a fresh session takes over
+	for _, msg := range []string{"first", "second", "after idle"} {
+		if msg == "after idle" {
+			time.Sleep(3 * timeout)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("reply to %q: %v", msg, err)
+		}
+		if got := string(buf[:n]); got != msg {
+			t.Errorf("got %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestUDPTimeoutMustBePositive(t *testing.T) {
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := newTestForwarder(listenUDPEcho(t, 0))
+		f.Protocol = "udp"
+		f.UDPTimeout = timeout
+		if err := f.ServePacket(pc); err == nil {
+			t.Errorf("ServePacket with UDPTimeout %v succeeded, want an error", timeout)
+		}
+		pc.Close()
+	}
+}
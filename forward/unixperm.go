@@ -0,0 +1,64 @@
+package forward
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// setSocketPerms applies UnixMode, UnixOwner and UnixGroup to the socket
+// file at path. Run calls it right after binding and before accepting,
+// so clients are held to the final permissions from the start.
+func (f *Forwarder) setSocketPerms(path string) error {
+	if f.UnixOwner != "" || f.UnixGroup != "" {
+		uid, gid := -1, -1
+		var err error
+		if f.UnixOwner != "" {
+			if uid, err = lookupID(f.UnixOwner, "user"); err != nil {
+				return err
+			}
+		}
+		if f.UnixGroup != "" {
+			if gid, err = lookupID(f.UnixGroup, "group"); err != nil {
+				return err
+			}
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return fmt.Errorf("failed to set owner of %s: %v", path, err)
+		}
+	}
+	if f.UnixMode != 0 {
+		if err := os.Chmod(path, f.UnixMode); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// lookupID resolves a user or group, given by name or numeric ID, to its
+// numeric ID.
+func lookupID(name, kind string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+	var id string
+	if kind == "user" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, err
+		}
+		id = u.Uid
+	} else {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return 0, err
+		}
+		id = g.Gid
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, fmt.Errorf("%s %q has non-numeric ID %s", kind, name, id)
+	}
+	return n, nil
+}
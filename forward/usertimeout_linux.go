@@ -0,0 +1,33 @@
+//go:build linux
+
+package forward
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// tcpUserTimeout is TCP_USER_TIMEOUT, which syscall does not define.
+const tcpUserTimeout = 0x12
+
+// setUserTimeout sets TCP_USER_TIMEOUT on conn, so the kernel drops it
+// once data it sent has gone unacknowledged for d. It is a variable so
+// that other platforms can leave it nil.
+var setUserTimeout = func(conn *net.TCPConn, d time.Duration) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to get raw connection: %v", err)
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(d.Milliseconds())); err != nil {
+			sockErr = fmt.Errorf("failed to set TCP_USER_TIMEOUT: %v", err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to access socket: %v", err)
+	}
+	return sockErr
+}
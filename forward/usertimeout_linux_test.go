@@ -0,0 +1,31 @@
+package forward
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTCPUserTimeout(t *testing.T) {
+	const timeout = 1500 * time.Millisecond
+	d := &recordingDialer{}
+	f := newTestForwarder(listenEcho(t).Addr().String())
+	f.Dialer = d
+	f.TCPUserTimeout = timeout
+	echo(t, serveTCP(t, f), []byte("hello"))
+
+	rawConn, err := d.last(t).(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got int
+	rawConn.Control(func(fd uintptr) {
+		got, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout)
+	})
+	if err != nil {
+		t.Fatalf("TCP_USER_TIMEOUT: %v", err)
+	}
+	if want := int(timeout.Milliseconds()); got != want {
+		t.Errorf("TCP_USER_TIMEOUT = %dms, want %dms", got, want)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package forward
+
+import (
+	"net"
+	"time"
+)
+
+// setUserTimeout is nil where TCP_USER_TIMEOUT is not available.
+var setUserTimeout func(conn *net.TCPConn, d time.Duration) error
@@ -1,182 +1,270 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
-	"net"
+	"log/slog"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
-)
 
-const (
-	bufferSize = 128 * 1024 // 128KB buffer for higher throughput
+	"github.com/maikirakiwi/goportforward/forward"
 )
 
-type Forwarder struct {
-	sourceAddr string
-	targetAddr string
-	isUnix     bool
-}
-
-func NewForwarder(source, target string) *Forwarder {
-	isUnix := false
-	if _, err := os.Stat(source); err == nil {
-		isUnix = true
+func main() {
+	var rule Rule
+	configPath := flag.String("config", "", "JSON file with a list of forwarding rules; other flags act as per-rule defaults")
+	var inline ruleSpecs
+	flag.Var(&inline, "rule", "Forward source=targets, instead of -source and -target (repeatable); other flags apply to every rule")
+	logLevel := flag.String("log-level", "info", "Minimum level of log messages (debug, info, warn or error)")
+	logFormat := flag.String("log-format", "text", "Log output format (text or json)")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics on this address, e.g. :9100 (disabled when empty)")
+	adminAddr := flag.String("admin-addr", "", "Serve a JSON admin API with live connections and stats on this address, e.g. 127.0.0.1:9101 (disabled when empty)")
+	accessLogPath := flag.String("access-log", "", "Append a line for every finished TCP connection to this file; reopened on SIGHUP for log rotation")
+	accessLogFormat := flag.String("access-log-format", "tsv", "Format of -access-log lines: tsv for tab-separated fields or json")
+	controlSocket := flag.String("control-socket", "", "Accept text commands (show stat, show conn, shutdown) on a Unix socket at this path (disabled when empty)")
+	webhookURL := flag.String("webhook-url", "", "POST a JSON event to this URL as each TCP connection opens and closes, in the background (disabled when empty)")
+	pprofAddr := flag.String("pprof-addr", "", "Serve Go's pprof profiles at /debug/pprof/ on this address, e.g. 127.0.0.1:6060 (disabled when empty)")
+	pidFile := flag.String("pidfile", "", "Write the process ID to this file while running")
+	showVersion := flag.Bool("version", false, "Print version and build information and exit")
+	flag.StringVar(&rule.Protocol, "protocol", "tcp", "Protocol to forward (tcp or udp)")
+	flag.StringVar(&rule.Source, "source", "", "Source address (Unix socket path or TCP port); a comma-separated list listens on each")
+	flag.StringVar(&rule.Target, "target", "", "Target address (Unix socket path or TCP port); a comma-separated list is balanced round-robin, addr=N weights a target; srv://name discovers targets via DNS SRV")
+	flag.StringVar(&rule.SourceType, "source-type", "", "Override source network detection (tcp, tcp4, tcp6 or unix); a scheme such as tcp4:// on an address takes precedence")
+	flag.StringVar(&rule.TargetType, "target-type", "", "Override target network detection (tcp, tcp4, tcp6 or unix); a scheme such as unix:// on an address takes precedence")
+	flag.StringVar(&rule.Family, "family", "any", "Restrict TCP sources and targets to one IP family: 4, 6 or any (tcp4:// and tcp6:// addresses keep their own)")
+	flag.DurationVar((*time.Duration)(&rule.DialTimeout), "dial-timeout", forward.DefaultDialTimeout, "Timeout for each connection attempt to the target (0 for no timeout)")
+	flag.IntVar(&rule.DialRetries, "dial-retries", 0, "Retry dialing the targets this many times, with exponential backoff, before dropping the client")
+	flag.DurationVar((*time.Duration)(&rule.DialRetryDelay), "dial-retry-delay", forward.DefaultDialRetryDelay, "Wait before the first dial retry; doubled after each retry")
+	flag.StringVar(&rule.RejectMessage, "reject-message", "", "Send this line to clients whose connection cannot reach any target, after all retries, before closing it (for text protocols)")
+	flag.DurationVar((*time.Duration)(&rule.FallbackDelay), "dial-fallback-delay", forward.DefaultFallbackDelay, "How long to wait on one IP family of a dual-stack target before also trying the other (0 tries addresses one after another)")
+	flag.DurationVar((*time.Duration)(&rule.DNSTTL), "dns-ttl", 0, "Cache the addresses of target host names for this long and dial them round-robin (0 resolves on every dial)")
+	flag.StringVar(&rule.DialSource, "dial-source", "", "Local IP address to make target connections from, e.g. to pick an interface on a multi-homed host")
+	flag.StringVar(&rule.SOCKS5, "socks5", "", "Dial targets through this SOCKS5 proxy, as [user:password@]host:port")
+	flag.StringVar(&rule.HTTPProxy, "http-proxy", "", "Dial targets through this HTTP proxy with CONNECT, as http://[user:password@]host:port")
+	flag.StringVar(&rule.LBStrategy, "lb-strategy", forward.RoundRobin, "How to pick a target for each connection: round-robin, least-conn for the fewest open connections, or sticky to keep each client IP on one target")
+	flag.DurationVar((*time.Duration)(&rule.ShutdownTimeout), "shutdown-timeout", forward.DefaultShutdownTimeout, "How long to let active connections drain on shutdown before closing them")
+	flag.DurationVar((*time.Duration)(&rule.UDPTimeout), "udp-timeout", forward.DefaultUDPTimeout, "Idle time after which a UDP session is reclaimed")
+	flag.DurationVar((*time.Duration)(&rule.IdleTimeout), "idle-timeout", 0, "Close TCP connections with no traffic in either direction for this long (0 disables)")
+	flag.DurationVar((*time.Duration)(&rule.ReadTimeout), "read-timeout", 0, "Close TCP connections when a single read from either side waits this long for data (0 disables)")
+	flag.DurationVar((*time.Duration)(&rule.WriteTimeout), "write-timeout", 0, "Close TCP connections when a single write to either side waits this long for the peer to accept it (0 disables)")
+	flag.IntVar(&rule.ReconnectTarget, "reconnect-target", 0, "When a target closes a TCP connection the client still uses, connect to a target again, up to this many times per connection (0 disables; unsafe for stateful protocols)")
+	flag.DurationVar((*time.Duration)(&rule.MaxLifetime), "max-lifetime", 0, "Close TCP connections this long after they were accepted, even if busy (0 disables)")
+	flag.IntVar(&rule.MaxFails, "max-fails", 0, "Eject a target after this many consecutive failed dials (0 disables)")
+	flag.DurationVar((*time.Duration)(&rule.FailTimeout), "fail-timeout", forward.DefaultFailTimeout, "How long an ejected target stays out of the rotation")
+	flag.DurationVar((*time.Duration)(&rule.HealthInterval), "health-interval", 0, "Probe each target this often and skip unhealthy ones (0 disables)")
+	flag.DurationVar((*time.Duration)(&rule.HealthTimeout), "health-timeout", forward.DefaultHealthTimeout, "Timeout for each health probe dial")
+	flag.DurationVar((*time.Duration)(&rule.LatencyInterval), "latency-interval", 0, "Measure the connect latency of each target this often, for metrics, the admin API and the log (0 disables)")
+	flag.DurationVar((*time.Duration)(&rule.LatencyWindow), "latency-window", forward.DefaultLatencyWindow, "Period over which -latency-interval probes are summarized as min/avg/max and logged")
+	flag.DurationVar((*time.Duration)(&rule.StatsInterval), "stats-interval", 0, "Log the bytes/sec copied each way and the active connections this often (0 disables)")
+	flag.Int64Var(&rule.RateLimit, "rate-limit", 0, "Per-connection bandwidth cap in bytes/sec, both directions combined (0 for unlimited)")
+	flag.Int64Var(&rule.UploadRate, "upload-rate", 0, "Per-connection bandwidth cap in bytes/sec from client to target (0 for unlimited)")
+	flag.Int64Var(&rule.DownloadRate, "download-rate", 0, "Per-connection bandwidth cap in bytes/sec from target to client (0 for unlimited)")
+	flag.Int64Var(&rule.GlobalRateLimit, "global-rate-limit", 0, "Bandwidth cap in bytes/sec shared by all connections of a forward (0 for unlimited)")
+	flag.IntVar(&rule.MaxConns, "max-conns", 0, "Maximum number of connections handled at once (0 for unlimited)")
+	flag.BoolVar(&rule.MaxConnsWait, "max-conns-wait", false, "At -max-conns, hold new connections until a slot frees up instead of rejecting them")
+	flag.DurationVar((*time.Duration)(&rule.QueueTimeout), "queue-timeout", 0, "At -max-conns, hold a new connection up to this long for a slot to free up before closing it (0 closes it immediately)")
+	flag.IntVar(&rule.AcceptRate, "accept-rate", 0, "Accept at most this many new TCP connections per second, holding back the excess, e.g. to let targets recover (0 for unlimited)")
+	flag.IntVar(&rule.MaxConnsPerIP, "max-conns-per-ip", 0, "Maximum number of open connections per client IP (0 for unlimited; ignored for Unix sources)")
+	flag.StringVar(&rule.Allow, "allow", "", "Comma-separated CIDR blocks allowed to connect (empty allows everyone)")
+	flag.StringVar(&rule.Deny, "deny", "", "Comma-separated CIDR blocks refused before the allow list is checked")
+	flag.StringVar(&rule.ProxyProtocol, "proxy-protocol", "", "Send a PROXY protocol header (v1 or v2) to the target with the real client address")
+	flag.BoolVar(&rule.AcceptProxyProtocol, "accept-proxy-protocol", false, "Expect and strip a PROXY protocol v1/v2 header from each client")
+	flag.BoolVar(&rule.ProxyProtocolOptional, "proxy-protocol-optional", false, "With -accept-proxy-protocol, pass through clients that send no header instead of rejecting them")
+	flag.StringVar(&rule.TLSCert, "tls-cert", "", "Certificate file for terminating TLS on the source (requires -tls-key)")
+	flag.StringVar(&rule.TLSKey, "tls-key", "", "Private key file for -tls-cert")
+	flag.StringVar(&rule.TLSMinVersion, "tls-min-version", "", "Minimum TLS version accepted on the source (1.0, 1.1, 1.2 or 1.3)")
+	flag.StringVar(&rule.TLSClientCA, "tls-client-ca", "", "CA bundle for verifying client certificates; clients without a valid certificate are rejected")
+	flag.BoolVar(&rule.TargetTLS, "target-tls", false, "Connect to the target over TLS")
+	flag.StringVar(&rule.TargetTLSServerName, "target-tls-servername", "", "Server name for SNI and certificate verification with -target-tls (defaults to the target host)")
+	flag.BoolVar(&rule.TargetTLSInsecure, "target-tls-insecure", false, "Skip verification of the target's certificate (for testing only)")
+	flag.StringVar(&rule.TargetTLSCert, "target-tls-cert", "", "Client certificate to present to the target with -target-tls (requires -target-tls-key)")
+	flag.StringVar(&rule.TargetTLSKey, "target-tls-key", "", "Private key file for -target-tls-cert")
+	flag.Var(&rule.SNIRoutes, "sni-route", "Route TLS connections for a server name to their own targets, as name=targets (repeatable); other connections go to -target")
+	flag.Var(&rule.ProtocolRoutes, "protocol-route", "Route connections whose first bytes identify them as tls, ssh or http to their own targets, as protocol=targets (repeatable); other connections go to -target")
+	flag.StringVar(&rule.Mirror, "mirror", "", "Also send a copy of each client's data to this address, discarding its replies (best effort)")
+	flag.StringVar(&rule.CaptureDir, "capture-dir", "", "Record each TCP connection's traffic in this directory, one file per direction (disabled when empty)")
+	flag.StringVar(&rule.CaptureFormat, "capture-format", "raw", "Format of -capture-dir files: raw bytes, or framed with a 4-byte big-endian length before each read")
+	flag.Int64Var(&rule.CaptureMaxBytes, "capture-max-bytes", forward.DefaultCaptureMaxBytes, "Stop recording a direction once its capture file reaches this size (0 for no limit)")
+	flag.StringVar(&rule.Compress, "compress", "", "Compress traffic to the target with deflate or gzip; the target must be a forwarder run with the same -decompress (none disables)")
+	flag.StringVar(&rule.Decompress, "decompress", "", "Decompress traffic from clients compressed with deflate or gzip by a forwarder run with the same -compress, and compress replies (none disables)")
+	flag.BoolVar(&rule.KeepAlive, "keepalive", true, "Enable TCP keep-alive on client and target connections")
+	flag.DurationVar((*time.Duration)(&rule.KeepAlivePeriod), "keepalive-period", forward.DefaultKeepAlive, "Interval between TCP keep-alive probes")
+	flag.DurationVar((*time.Duration)(&rule.TCPUserTimeout), "tcp-user-timeout", 0, "Drop TCP connections whose sent data stays unacknowledged this long, via TCP_USER_TIMEOUT (Linux; 0 keeps the OS default)")
+	flag.IntVar(&rule.Linger, "linger", forward.DefaultLinger, "SO_LINGER in seconds for client and target connections: -1 keeps the OS default, 0 resets connections on close, discarding unsent data")
+	flag.IntVar(&rule.RecvBuffer, "rcvbuf", forward.DefaultSocketBuffer, "Kernel receive buffer size in bytes for TCP connections (0 keeps the OS default)")
+	flag.IntVar(&rule.SendBuffer, "sndbuf", forward.DefaultSocketBuffer, "Kernel send buffer size in bytes for TCP connections (0 keeps the OS default)")
+	flag.IntVar(&rule.BufferSize, "buffer-size", forward.DefaultBufferSize, "Size in bytes of the buffer used to copy each direction when the kernel can't splice (0 uses the Go default of 32 KiB)")
+	flag.Int64Var(&rule.MaxBufferedBytes, "max-buffered-bytes", 0, "Cap the memory all TCP connections may hold in copy buffers together; connections beyond it wait (0 for unlimited)")
+	flag.BoolVar(&rule.StrictOptimize, "strict-optimize", false, "Drop connections whose socket options (TCP_NODELAY, keep-alive, buffers, DSCP) cannot be set, instead of forwarding them untuned")
+	flag.BoolVar(&rule.NoOptimize, "no-optimize", false, "Leave client and target sockets as Go sets them up, ignoring the keep-alive, buffer, DSCP, TCP user timeout and linger settings, to rule out socket tuning when debugging")
+	flag.IntVar(&rule.Backlog, "backlog", 0, "Length of the kernel's queue of TCP connections waiting to be accepted (0 keeps the system default)")
+	flag.BoolVar(&rule.ReusePort, "reuseport", false, "Set SO_REUSEPORT on the listener so a new process can bind the same address while this one drains")
+	flag.BoolVar(&rule.MPTCP, "mptcp", false, "Use Multipath TCP on the listener and to the targets where the kernel supports it, falling back to TCP")
+	flag.BoolVar(&rule.Transparent, "transparent", false, "Transparent proxy mode (Linux): forward each connection to its original destination from the client's own IP; -target is not needed")
+	flag.StringVar(&rule.UnixMode, "unix-mode", "", "Permissions of a Unix socket source, in octal, e.g. 0660 (default: as created under the umask)")
+	flag.StringVar(&rule.UnixOwner, "unix-owner", "", "User, by name or ID, to own a Unix socket source")
+	flag.StringVar(&rule.UnixGroup, "unix-group", "", "Group, by name or ID, to own a Unix socket source")
+	flag.BoolVar(&rule.PeerCred, "peer-cred", false, "Log the PID, UID and GID of the process behind each Unix socket client, read with SO_PEERCRED (Linux)")
+	flag.IntVar(&rule.DSCP, "dscp", 0, "Mark forwarded TCP traffic on both sides with this DSCP value, 0-63 (0 leaves it unmarked)")
+	flag.Parse()
+	if err := applyEnv(flag.CommandLine); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
 	}
-	return &Forwarder{
-		sourceAddr: source,
-		targetAddr: target,
-		isUnix:     isUnix,
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return
 	}
-}
 
-func optimizeConn(conn net.Conn) error {
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		// Disable Nagle's algorithm
-		if err := tcpConn.SetNoDelay(true); err != nil {
-			return fmt.Errorf("failed to set TCP_NODELAY: %v", err)
-		}
-		// Set TCP keepalive
-		if err := tcpConn.SetKeepAlive(true); err != nil {
-			return fmt.Errorf("failed to set TCP keepalive: %v", err)
-		}
-		// Set keepalive period to 30 seconds
-		if err := tcpConn.SetKeepAlivePeriod(30 * time.Second); err != nil {
-			return fmt.Errorf("failed to set TCP keepalive period: %v", err)
-		}
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
 
-		// Get the underlying file descriptor
-		file, err := tcpConn.File()
+	rules := []Rule{rule}
+	switch {
+	case *configPath != "" && len(inline) > 0:
+		fatal(errors.New("-rule cannot be combined with -config"))
+	case *configPath != "":
+		rules, err = loadConfig(*configPath, rule)
 		if err != nil {
-			return fmt.Errorf("failed to get file descriptor: %v", err)
-		}
-		defer file.Close()
-
-		// Set socket options for high throughput
-		if err := syscall.SetsockoptInt(int(file.Fd()), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 1024*1024); err != nil {
-			return fmt.Errorf("failed to set SO_RCVBUF: %v", err)
+			fatal(err)
 		}
-		if err := syscall.SetsockoptInt(int(file.Fd()), syscall.SOL_SOCKET, syscall.SO_SNDBUF, 1024*1024); err != nil {
-			return fmt.Errorf("failed to set SO_SNDBUF: %v", err)
+	case len(inline) > 0:
+		if rule.Source != "" || rule.Target != "" {
+			fatal(errors.New("-rule cannot be combined with -source or -target"))
 		}
+		rules = inlineRules(inline, rule)
+	case rule.Source == "" || (rule.Target == "" && !rule.Transparent):
+		fatal(errors.New("both source and target addresses must be specified"))
 	}
-	return nil
-}
-
-// OptimizedWriter implements a zero-copy writer
-type OptimizedWriter struct {
-	conn net.Conn
-}
-
-func (w *OptimizedWriter) Write(p []byte) (n int, err error) {
-	return w.conn.Write(p)
-}
-
-func (f *Forwarder) Start() error {
-	var listener net.Listener
-	var err error
-
-	if f.isUnix {
-		listener, err = net.Listen("unix", f.sourceAddr)
-	} else {
-		listener, err = net.Listen("tcp", f.sourceAddr)
-	}
-
-	if err != nil {
-		return fmt.Errorf("failed to start listener: %v", err)
-	}
-	defer listener.Close()
-
-	log.Printf("Forwarding from %s to %s\n", f.sourceAddr, f.targetAddr)
 
 	// Handle graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	go func() {
-		<-sigChan
-		log.Println("Shutting down...")
-		listener.Close()
-		os.Exit(0)
-	}()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, shutdown := context.WithCancel(ctx)
+	defer shutdown()
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Error accepting connection: %v\n", err)
-			continue
+	sup := newSupervisor(ctx)
+	sup.liveBytes = *adminAddr != "" || *controlSocket != "" || dumpSignal != nil
+	if *accessLogPath != "" {
+		if sup.accessLog, err = openAccessLog(*accessLogPath, *accessLogFormat); err != nil {
+			fatal(err)
 		}
-
-		if err := optimizeConn(conn); err != nil {
-			log.Printf("Failed to optimize connection: %v\n", err)
-			conn.Close()
-			continue
+		defer sup.accessLog.Close()
+	}
+	if *webhookURL != "" {
+		if sup.webhook, err = startWebhook(*webhookURL); err != nil {
+			fatal(err)
 		}
-
-		go f.handleConnection(conn)
 	}
-}
-
-func (f *Forwarder) handleConnection(clientConn net.Conn) {
-	defer clientConn.Close()
-
-	var targetConn net.Conn
-	var err error
-
-	if f.isUnix {
-		targetConn, err = net.Dial("unix", f.targetAddr)
-	} else {
-		targetConn, err = net.Dial("tcp", f.targetAddr)
+	if err := sup.apply(rules); err != nil {
+		fatal(err)
 	}
-
-	if err != nil {
-		log.Printf("Failed to connect to target: %v\n", err)
-		return
+	if *metricsAddr != "" {
+		if err := startMetrics(ctx, *metricsAddr, sup); err != nil {
+			fatal(err)
+		}
 	}
-	defer targetConn.Close()
-
-	if err := optimizeConn(targetConn); err != nil {
-		log.Printf("Failed to optimize target connection: %v\n", err)
-		return
+	if *adminAddr != "" {
+		if err := startAdmin(ctx, *adminAddr, sup); err != nil {
+			fatal(err)
+		}
+	}
+	if *pprofAddr != "" {
+		if err := startPprof(ctx, *pprofAddr); err != nil {
+			fatal(err)
+		}
+	}
+	if *controlSocket != "" {
+		if err := startControl(ctx, *controlSocket, sup, shutdown); err != nil {
+			fatal(err)
+		}
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	handleDumpSignal(ctx, sup)
 
-	// Create optimized writers for zero-copy
-	clientWriter := &OptimizedWriter{conn: clientConn}
-	targetWriter := &OptimizedWriter{conn: targetConn}
+	// Reload the config file and reopen the access log on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
-	// Use io.Copy with optimized writers for zero-copy transfer
-	go func() {
-		defer wg.Done()
-		io.Copy(targetWriter, clientConn)
-	}()
+	// Only advertise the PID once SIGHUP is handled, so scripts using it
+	// cannot kill the process by accident
+	if *pidFile != "" {
+		if err := writePIDFile(*pidFile); err != nil {
+			fatal(err)
+		}
+	}
 
 	go func() {
-		defer wg.Done()
-		io.Copy(clientWriter, targetConn)
+		for {
+			select {
+			case <-ctx.Done():
+				signal.Stop(hup)
+				return
+			case <-hup:
+			}
+			if sup.accessLog != nil {
+				if err := sup.accessLog.reopen(); err != nil {
+					slog.Error("Failed to reopen access log, keeping the current file", "error", err)
+				}
+			}
+			if *configPath == "" {
+				if sup.accessLog == nil {
+					slog.Warn("Received SIGHUP but no -config file is in use, ignoring")
+				}
+				continue
+			}
+			slog.Info("Reloading config", "path", *configPath)
+			rules, err := loadConfig(*configPath, rule)
+			if err == nil {
+				err = sup.apply(rules)
+			}
+			if err != nil {
+				slog.Error("Reload failed, keeping current rules", "error", err)
+			}
+		}
 	}()
 
-	wg.Wait()
+	err = sup.wait()
+	if sup.webhook != nil {
+		sup.webhook.close()
+	}
+	if *pidFile != "" {
+		removePIDFile(*pidFile)
+	}
+	if err != nil {
+		fatal(err)
+	}
 }
 
-func main() {
-	source := flag.String("source", "", "Source address (Unix socket path or TCP port)")
-	target := flag.String("target", "", "Target address (Unix socket path or TCP port)")
-	flag.Parse()
-
-	if *source == "" || *target == "" {
-		log.Fatal("Both source and target addresses must be specified")
+// newLogger builds the process logger from the -log-level and -log-format
+// flags.
+func newLogger(level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q (want debug, info, warn or error)", level)
 	}
-
-	forwarder := NewForwarder(*source, *target)
-	if err := forwarder.Start(); err != nil {
-		log.Fatalf("Error: %v\n", err)
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q (want text or json)", format)
 	}
 }
+
+// fatal logs err and exits.
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
+}
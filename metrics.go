@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maikirakiwi/goportforward/forward"
+)
+
+// startMetrics serves Prometheus metrics for sup's rules on addr until ctx
+// is done.
+func startMetrics(ctx context.Context, addr string, sup *supervisor) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, sup.stats())
+		if sup.webhook != nil {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", webhookDroppedMetric,
+				"Webhook events dropped because the queue was full.", webhookDroppedMetric, webhookDroppedMetric, sup.webhook.dropped.Load())
+		}
+	})
+	ln, err := serveHTTP(ctx, "metrics", addr, mux)
+	if err != nil {
+		return err
+	}
+	slog.Info("Serving metrics", "url", "http://"+ln.Addr().String()+"/metrics")
+	return nil
+}
+
+// serveHTTP serves handler on addr until ctx is done. name identifies the
+// server in errors and logs.
+func serveHTTP(ctx context.Context, name, addr string, handler http.Handler) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start %s listener: %v", name, err)
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("HTTP server failed", "server", name, "error", err)
+		}
+	}()
+	context.AfterFunc(ctx, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return ln, nil
+}
+
+// metric is one family in the Prometheus text format.
+type metric struct {
+	name, kind, help string
+	direction        string // value of the direction label, if any
+	value            func(forward.Stats) float64
+}
+
+var metrics = []metric{
+	{name: "goportforward_connections_accepted_total", kind: "counter", help: "Connections accepted on the source.",
+		value: func(s forward.Stats) float64 { return float64(s.Accepted) }},
+	{name: "goportforward_connections_failed_total", kind: "counter", help: "Connections rejected or never connected to a target.",
+		value: func(s forward.Stats) float64 { return float64(s.Failed) }},
+	{name: "goportforward_connections_active", kind: "gauge", help: "Connections currently being forwarded.",
+		value: func(s forward.Stats) float64 { return float64(s.Active) }},
+	{name: "goportforward_bytes_total", kind: "counter", help: "Bytes forwarded, by direction.", direction: "to_target",
+		value: func(s forward.Stats) float64 { return float64(s.BytesSent) }},
+	{name: "goportforward_bytes_total", direction: "to_client",
+		value: func(s forward.Stats) float64 { return float64(s.BytesReceived) }},
+}
+
+const webhookDroppedMetric = "goportforward_webhook_events_dropped_total"
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetrics(w io.Writer, stats []ruleStats) {
+	for _, m := range metrics {
+		if m.help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		}
+		for _, rs := range stats {
+			labels := fmt.Sprintf(`protocol="%s",source="%s",target="%s"`,
+				labelEscaper.Replace(rs.rule.Protocol), labelEscaper.Replace(rs.rule.Source), labelEscaper.Replace(rs.rule.Target))
+			if m.direction != "" {
+				labels += `,direction="` + m.direction + `"`
+			}
+			fmt.Fprintf(w, "%s{%s} %s\n", m.name, labels, strconv.FormatFloat(m.value(rs.stats), 'f', -1, 64))
+		}
+	}
+	writeLatencyMetrics(w, stats)
+}
+
+const latencyMetric = "goportforward_target_latency_seconds"
+
+// writeLatencyMetrics reports the latest connect latency of each target
+// probed with -latency-interval, labelled with the rule and the target as
+// backend. Targets without a successful probe yet are left out.
+func writeLatencyMetrics(w io.Writer, stats []ruleStats) {
+	header := false
+	for _, rs := range stats {
+		for _, l := range rs.latencies {
+			if l.LastAt.IsZero() {
+				continue
+			}
+			if !header {
+				fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", latencyMetric,
+					"Time the latest latency probe took to connect to the target.", latencyMetric)
+				header = true
+			}
+			fmt.Fprintf(w, `%s{protocol="%s",source="%s",target="%s",backend="%s"} %s`+"\n", latencyMetric,
+				labelEscaper.Replace(rs.rule.Protocol), labelEscaper.Replace(rs.rule.Source), labelEscaper.Replace(rs.rule.Target),
+				labelEscaper.Replace(l.Target), strconv.FormatFloat(l.Last.Seconds(), 'f', -1, 64))
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// writePIDFile writes the process ID to path. A file left behind by an
+// earlier run is overwritten with a warning, since a crashed process
+// cannot clean up after itself.
+func writePIDFile(path string) error {
+	if old, err := os.ReadFile(path); err == nil {
+		slog.Warn("Overwriting existing pidfile", "path", path, "pid", strings.TrimSpace(string(old)))
+	}
+	pid := strconv.Itoa(os.Getpid())
+	if err := os.WriteFile(path, []byte(pid+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write pidfile: %v", err)
+	}
+	return nil
+}
+
+// removePIDFile deletes the pidfile at path, unless another process has
+// taken it over in the meantime.
+func removePIDFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		slog.Warn("Failed to remove pidfile", "path", path, "error", err)
+	}
+}
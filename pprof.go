@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+)
+
+// startPprof serves the net/http/pprof profiles on addr until ctx is done.
+// They are registered on a mux of their own rather than
+// http.DefaultServeMux, so they never show up on the other servers.
+func startPprof(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	ln, err := serveHTTP(ctx, "pprof", addr, mux)
+	if err != nil {
+		return err
+	}
+	slog.Info("Serving pprof", "url", "http://"+ln.Addr().String()+"/debug/pprof/")
+	return nil
+}
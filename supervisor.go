@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maikirakiwi/goportforward/forward"
+)
+
+// supervisor runs one Forwarder per Rule and can swap the rule set while
+// running, leaving rules that did not change untouched.
+type supervisor struct {
+	ctx context.Context
+
+	// liveBytes sets Forwarder.LiveBytes on every forwarder started, for
+	// the admin API, the control socket and the connection dump
+	liveBytes bool
+
+	// accessLog, when set, gets a line for every connection
+	accessLog *accessLog
+
+	// webhook, when set, is told about every connection
+	webhook *webhook
+
+	mu       sync.Mutex
+	running  map[Rule]*forward.Forwarder
+	draining bool // set by drain; rules added later start drained
+	errs     []error
+	wg       sync.WaitGroup
+}
+
+func newSupervisor(ctx context.Context) *supervisor {
+	return &supervisor{
+		ctx:     ctx,
+		running: make(map[Rule]*forward.Forwarder),
+	}
+}
+
+// apply makes rules the running set. Every rule is validated before
+// anything changes, so an invalid rule set leaves the current one in
+// place. Removed rules drain their connections per their shutdown timeout.
+func (s *supervisor) apply(rules []Rule) error {
+	wanted := make(map[Rule]*forward.Forwarder, len(rules))
+	for i, r := range rules {
+		if _, dup := wanted[r]; dup {
+			continue
+		}
+		f, err := newForwarder(r)
+		if err != nil {
+			return fmt.Errorf("rule %d (%s): %v", i+1, r, err)
+		}
+		f.LiveBytes = s.liveBytes
+		if s.accessLog != nil {
+			s.accessLog.hook(f, r.Source)
+		}
+		if s.webhook != nil {
+			s.webhook.hook(f, r.Source)
+		}
+		wanted[r] = f
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Stop removed rules first so their addresses are free for new ones
+	for r, f := range s.running {
+		if _, ok := wanted[r]; ok {
+			continue
+		}
+		slog.Info("Removing rule", "rule", r.String())
+		f.Stop()
+		delete(s.running, r)
+	}
+
+	for _, r := range rules {
+		f, ok := wanted[r]
+		if !ok {
+			continue
+		}
+		delete(wanted, r)
+		if _, ok := s.running[r]; ok {
+			slog.Info("Keeping rule", "rule", r.String())
+			continue
+		}
+		slog.Info("Adding rule", "rule", r.String())
+		if s.draining {
+			f.Drain()
+		}
+		s.running[r] = f
+		s.start(r, f)
+	}
+	return nil
+}
+
+// addOnConnect makes f call fn as each connection reaches a target, after
+// any OnConnect already set.
+func addOnConnect(f *forward.Forwarder, fn func(id uint64, client, target net.Addr)) {
+	prev := f.OnConnect
+	if prev == nil {
+		f.OnConnect = fn
+		return
+	}
+	f.OnConnect = func(id uint64, client, target net.Addr) {
+		prev(id, client, target)
+		fn(id, client, target)
+	}
+}
+
+// addOnClose makes f call fn as each connection closes, after any OnClose
+// already set.
+func addOnClose(f *forward.Forwarder, fn func(id uint64, client net.Addr, bytesIn, bytesOut int64, dur time.Duration, err error)) {
+	prev := f.OnClose
+	if prev == nil {
+		f.OnClose = fn
+		return
+	}
+	f.OnClose = func(id uint64, client net.Addr, bytesIn, bytesOut int64, dur time.Duration, err error) {
+		prev(id, client, bytesIn, bytesOut, dur, err)
+		fn(id, client, bytesIn, bytesOut, dur, err)
+	}
+}
+
+func (s *supervisor) start(r Rule, f *forward.Forwarder) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := f.Run(s.ctx)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.running[r] == f {
+			delete(s.running, r)
+		}
+		if err != nil {
+			slog.Error("Rule failed", "rule", r.String(), "error", err)
+			s.errs = append(s.errs, fmt.Errorf("rule %s: %v", r, err))
+		}
+	}()
+}
+
+// ruleStats pairs a running rule with its counters.
+type ruleStats struct {
+	rule      Rule
+	stats     forward.Stats
+	latencies []forward.TargetLatency
+}
+
+// stats returns the counters of every running rule, ordered by rule.
+func (s *supervisor) stats() []ruleStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]ruleStats, 0, len(s.running))
+	for r, f := range s.running {
+		out = append(out, ruleStats{rule: r, stats: f.Stats(), latencies: f.Latencies()})
+	}
+	slices.SortFunc(out, func(a, b ruleStats) int {
+		return strings.Compare(a.rule.String(), b.rule.String())
+	})
+	return out
+}
+
+// ruleConns pairs a running rule with its open connections.
+type ruleConns struct {
+	rule  Rule
+	conns []forward.ConnStats
+}
+
+// conns returns the open connections of every running rule, ordered by
+// rule.
+func (s *supervisor) conns() []ruleConns {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]ruleConns, 0, len(s.running))
+	for r, f := range s.running {
+		out = append(out, ruleConns{rule: r, conns: f.Conns()})
+	}
+	slices.SortFunc(out, func(a, b ruleConns) int {
+		return strings.Compare(a.rule.String(), b.rule.String())
+	})
+	return out
+}
+
+// closeConn closes the connection with the given ID in whichever rule
+// it belongs to, and reports whether one was found.
+func (s *supervisor) closeConn(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.running {
+		if f.CloseConn(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// drain stops every rule from accepting connections while letting the
+// active ones carry on. It reports false if the rules were already
+// draining.
+func (s *supervisor) drain() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.draining = true
+	for _, f := range s.running {
+		f.Drain()
+	}
+	return true
+}
+
+// status reports whether the rules are draining and how many connections
+// and UDP sessions they have open.
+func (s *supervisor) status() (draining bool, active int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.running {
+		active += f.Stats().Active
+	}
+	return s.draining, active
+}
+
+// wait blocks until every forwarder has returned and reports the ones that
+// failed.
+func (s *supervisor) wait() error {
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Join(s.errs...)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// parseTLSVersion maps a version such as "1.2" to its crypto/tls constant.
+// The empty string leaves the crypto/tls default in place.
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", v)
+	}
+}
+
+// loadKeyPair loads an optional certificate and key; what names the pair
+// in error messages.
+func loadKeyPair(what, certFile, keyFile string) ([]tls.Certificate, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("%s needs both a certificate and a key", what)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s certificate: %v", what, err)
+	}
+	return []tls.Certificate{cert}, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig builds the TLS config for terminating TLS on r's source,
+// or returns nil if r does not enable it.
+func serverTLSConfig(r Rule) (*tls.Config, error) {
+	certs, err := loadKeyPair("TLS", r.TLSCert, r.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	if certs == nil {
+		if r.TLSClientCA != "" {
+			return nil, errors.New("-tls-client-ca requires -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+
+	minVersion, err := parseTLSVersion(r.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: certs,
+		MinVersion:   minVersion,
+	}
+	if r.TLSClientCA != "" {
+		if config.ClientCAs, err = loadCertPool(r.TLSClientCA); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// targetTLSConfig builds the TLS config for connecting to r's targets, or
+// returns nil if r does not enable it.
+func targetTLSConfig(r Rule) (*tls.Config, error) {
+	certs, err := loadKeyPair("target TLS client", r.TargetTLSCert, r.TargetTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	if !r.TargetTLS {
+		if certs != nil {
+			return nil, errors.New("-target-tls-cert requires -target-tls")
+		}
+		return nil, nil
+	}
+	return &tls.Config{
+		Certificates:       certs,
+		ServerName:         r.TargetTLSServerName,
+		InsecureSkipVerify: r.TargetTLSInsecure,
+	}, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build information, set at link time with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=abc123 -X main.date=2025-01-02"
+//
+// The commit and date fall back to what the Go toolchain recorded from
+// the working copy, if anything.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// versionString describes this build for -version.
+func versionString() string {
+	c, d, goVersion := commit, date, "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		goVersion = info.GoVersion
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && c == "":
+				c = s.Value
+			case s.Key == "vcs.time" && d == "":
+				d = s.Value
+			}
+		}
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	return fmt.Sprintf("goportforward %s (commit %s, built %s, %s)", version, c, d, goVersion)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maikirakiwi/goportforward/forward"
+)
+
+const (
+	// webhookQueue is how many events may wait to be sent; further ones
+	// are dropped.
+	webhookQueue = 1024
+
+	// webhookTimeout bounds each POST to the webhook.
+	webhookTimeout = 5 * time.Second
+
+	// webhookFlushTimeout bounds sending the events still queued on
+	// shutdown.
+	webhookFlushTimeout = 10 * time.Second
+)
+
+// webhook POSTs an event to a URL as each connection opens and closes.
+// Events are queued and sent one at a time in the background, so a slow
+// or failing webhook never holds up forwarding.
+type webhook struct {
+	url    string
+	client *http.Client
+	events chan *webhookEvent
+
+	dropped  atomic.Uint64 // events that found the queue full
+	reported uint64        // dropped count last logged, for the sender
+	failed   int           // events that could not be sent since the last success, for the sender
+
+	targets sync.Map // connection ID -> target address, between connect and close
+
+	ctx    context.Context // cancelled once the flush on shutdown is over
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// webhookEvent is the JSON body of a POST. Close events also carry the
+// webhookClose fields.
+type webhookEvent struct {
+	Event  string    `json:"event"` // "open" or "close"
+	Time   time.Time `json:"time"`
+	ID     uint64    `json:"conn"`
+	Source string    `json:"source"`
+	Client string    `json:"client"`
+	Target string    `json:"target,omitempty"`
+	*webhookClose
+}
+
+type webhookClose struct {
+	BytesIn  int64   `json:"bytes_in"`
+	BytesOut int64   `json:"bytes_out"`
+	Duration float64 `json:"duration"` // seconds
+	Reason   string  `json:"reason"`
+}
+
+// startWebhook starts sending events to rawURL, an http or https URL.
+func startWebhook(rawURL string) (*webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q (want http:// or https://)", rawURL)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhook{
+		url:    rawURL,
+		client: &http.Client{Timeout: webhookTimeout},
+		events: make(chan *webhookEvent, webhookQueue),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// hook makes f report its connections, tagged with the rule's source.
+func (w *webhook) hook(f *forward.Forwarder, source string) {
+	addOnConnect(f, func(id uint64, client, target net.Addr) {
+		w.targets.Store(id, target.String())
+		w.enqueue(&webhookEvent{Event: "open", Time: time.Now(), ID: id, Source: source,
+			Client: client.String(), Target: target.String()})
+	})
+	addOnClose(f, func(id uint64, client net.Addr, bytesIn, bytesOut int64, dur time.Duration, err error) {
+		e := &webhookEvent{Event: "close", Time: time.Now(), ID: id, Source: source, Client: client.String(),
+			webhookClose: &webhookClose{BytesIn: bytesIn, BytesOut: bytesOut, Duration: dur.Seconds(), Reason: closeReason(err)}}
+		if target, ok := w.targets.LoadAndDelete(id); ok {
+			e.Target = target.(string)
+		}
+		w.enqueue(e)
+	})
+}
+
+// enqueue queues e, or drops it if the queue is full.
+func (w *webhook) enqueue(e *webhookEvent) {
+	select {
+	case w.events <- e:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+	for e := range w.events {
+		if w.ctx.Err() != nil {
+			// The flush on shutdown timed out
+			w.dropped.Add(1)
+			continue
+		}
+		// Only the first of a run of failures is logged, so a webhook
+		// that is down does not flood the log
+		if err := w.post(e); err != nil {
+			if w.failed == 0 {
+				slog.Warn("Failed to send webhook event", "event", e.Event, "conn", e.ID, "error", err)
+			}
+			w.failed++
+		} else if w.failed > 0 {
+			slog.Info("Webhook events are being delivered again", "failed", w.failed)
+			w.failed = 0
+		}
+		if dropped := w.dropped.Load(); dropped != w.reported {
+			slog.Warn("Webhook queue full, dropped events", "dropped", dropped-w.reported, "total", dropped)
+			w.reported = dropped
+		}
+	}
+	if dropped := w.dropped.Load(); dropped != w.reported {
+		slog.Warn("Gave up sending webhook events on shutdown", "dropped", dropped-w.reported, "total", dropped)
+	}
+}
+
+func (w *webhook) post(e *webhookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Drain the answer so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// close sends the events still queued, giving up after
+// webhookFlushTimeout. No events may be reported once it is called.
+func (w *webhook) close() {
+	close(w.events)
+	t := time.AfterFunc(webhookFlushTimeout, w.cancel)
+	defer t.Stop()
+	<-w.done
+	w.cancel()
+}